@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/manifoldco/promptui"
+)
+
+// activeAccount is the user whose token caches are used, empty until known
+var activeAccount string
+
+var accountNamePattern = regexp.MustCompile(`[^a-z0-9@._-]`)
+
+var errAmbiguousAccount = errors.New("Specify the --account option since multiple accounts are signed in")
+
+// accountName normalizes a user name into the name of its cache directory
+func accountName(name string) string {
+	return accountNamePattern.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "_")
+}
+
+func accountCacheDir(account string) string {
+	return filepath.Join(tokenCacheDir(), "accounts", account)
+}
+
+// tokenAccount returns the account a user token was issued to, or empty for
+// tokens of applications.
+func tokenAccount(token adal.Token) string {
+	claims, err := parseTokenClaims(token.AccessToken)
+	if err != nil {
+		return ""
+	}
+
+	return accountName(claimString(claims, "upn", "unique_name", "email", "preferred_username"))
+}
+
+// cachedAccounts lists the accounts with token caches
+func cachedAccounts() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(tokenCacheDir(), "accounts"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	accounts := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		if caches, _ := filepath.Glob(filepath.Join(accountCacheDir(e.Name()), "accessToken.*.json")); len(caches) > 0 {
+			accounts = append(accounts, e.Name())
+		}
+	}
+
+	sort.Strings(accounts)
+	return accounts, nil
+}
+
+// selectAccount picks the account to sign in with: the --account option, the
+// only cached account, or the one chosen in a prompt when several are cached.
+func selectAccount() error {
+	if err := migrateLegacyTokenCaches(); err != nil {
+		return err
+	}
+
+	if activeAccount != "" {
+		return nil
+	}
+
+	accounts, err := cachedAccounts()
+	if err != nil {
+		return err
+	}
+
+	switch len(accounts) {
+	case 0:
+		return nil
+	case 1:
+		activeAccount = accounts[0]
+		return nil
+	}
+
+	if authFlags.noPrompt {
+		return errAmbiguousAccount
+	}
+
+	prompt := promptui.Select{
+		Label: "Select Account",
+		Items: accounts,
+	}
+
+	index, _, err := prompt.Run()
+	if err != nil {
+		return errAmbiguousAccount
+	}
+
+	activeAccount = accounts[index]
+	return nil
+}
+
+// accountError wraps a selectAccount error, an ambiguous account is a usage error
+func accountError(err error) error {
+	if err == errAmbiguousAccount {
+		return newError(usageFailure, err, "Failed to select the account")
+	}
+
+	return newError(authFailure, err, "Failed to select the account")
+}
+
+// migrateLegacyTokenCaches moves the per-tenant caches of earlier versions
+// into the directory of the account they belong to.
+func migrateLegacyTokenCaches() error {
+	unlock, err := lockTokenCache()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	files, err := listCachedTokenFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.Account != "" {
+			continue
+		}
+
+		token, err := loadTokenFile(f.Path)
+		if err != nil {
+			continue
+		}
+
+		account := tokenAccount(*token)
+		if account == "" {
+			continue
+		}
+
+		target := filepath.Join(accountCacheDir(account), filepath.Base(f.Path))
+		if _, err := os.Stat(target); err == nil {
+			// A newer cache of the account exists already
+			os.Remove(f.Path)
+			continue
+		}
+
+		if err := saveTokenFile(target, *token); err != nil {
+			return fmt.Errorf("Failed to migrate token cache %s: %v", f.Path, err)
+		}
+
+		os.Remove(f.Path)
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cachedTokenFile is a token cache file found in $HOME/.azshell
+type cachedTokenFile struct {
+	Path     string
+	Account  string
+	Cloud    string
+	TenantID string
+}
+
+// listCachedTokenFiles finds the token caches of all accounts and clouds.
+// Their names are [accounts/<account>/]accessToken.[<cloud>@]<tenant>.json,
+// see defaultTokenCachePath.
+func listCachedTokenFiles() ([]cachedTokenFile, error) {
+	paths, err := filepath.Glob(filepath.Join(tokenCacheDir(), "accessToken.*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	accountPaths, err := filepath.Glob(filepath.Join(accountCacheDir("*"), "accessToken.*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []cachedTokenFile{}
+	for _, p := range append(paths, accountPaths...) {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), "accessToken."), ".json")
+		f := cachedTokenFile{Path: p, Cloud: azurePublicCloud.Name, TenantID: name}
+		if filepath.Dir(p) != tokenCacheDir() {
+			f.Account = filepath.Base(filepath.Dir(p))
+		}
+
+		if i := strings.Index(name, cloudTenantSeparator); i >= 0 {
+			f.Cloud = name[:i]
+			f.TenantID = name[i+len(cloudTenantSeparator):]
+			if c, ok := clouds[f.Cloud]; ok {
+				f.Cloud = c.Name
+			}
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+func runAuth(args []string) error {
+	if len(args) == 0 {
+		return newError(usageFailure, nil, "Usage: %s auth list|logout", os.Args[0])
+	}
+
+	switch args[0] {
+	case "list":
+		return runAuthList(args[1:])
+	case "logout":
+		return runAuthLogout(args[1:])
+	default:
+		return newError(usageFailure, nil, "Unknown auth command '%s', use list or logout", args[0])
+	}
+}
+
+func runAuthList(args []string) error {
+	fs := flag.NewFlagSet("auth list", flag.ExitOnError)
+	fs.Parse(args)
+
+	if err := configureCredentials(""); err != nil {
+		return newError(usageFailure, err, "Invalid options")
+	}
+
+	files, err := listCachedTokenFiles()
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		fmt.Println("No cached tokens.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tTENANT\tCLOUD\tUSER\tEXPIRES\tREFRESH TOKEN")
+	for _, f := range files {
+		// Listing must not rewrite the caches, plaintext ones are encrypted when used
+		token, _, err := readTokenFile(f.Path)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t<%v>\t\t\n", f.Account, f.TenantID, f.Cloud, err)
+			continue
+		}
+
+		user := ""
+		if claims, err := parseTokenClaims(token.AccessToken); err == nil {
+			user = claimString(claims, "upn", "unique_name", "email", "appid")
+		}
+
+		expires := token.Expires().Local().Format(time.RFC3339)
+		if token.IsExpired() {
+			expires += " (expired)"
+		}
+
+		hasRefreshToken := "no"
+		if token.RefreshToken != "" {
+			hasRefreshToken = "yes"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", f.Account, f.TenantID, f.Cloud, user, expires, hasRefreshToken)
+	}
+
+	return w.Flush()
+}
+
+func runAuthLogout(args []string) error {
+	var account, tenantID string
+	var all bool
+
+	fs := flag.NewFlagSet("auth logout", flag.ExitOnError)
+	fs.StringVar(&account, "account", "", "Remove the cached tokens of this account.")
+	fs.StringVar(&tenantID, "tenant", "", "Remove the cached tokens of this tenant.")
+	fs.BoolVar(&all, "all", false, "Remove the cached tokens of all accounts and tenants.")
+	fs.Parse(args)
+
+	if account == "" && tenantID == "" && !all {
+		return newError(usageFailure, nil, "Specify --account, --tenant or --all")
+	}
+
+	removed, err := removeCachedTokens(accountName(account), tenantID)
+	if err != nil {
+		return err
+	}
+
+	// Azure AD has no endpoint to revoke a single refresh token of a public
+	// client, deleting the cache is what can be done locally.
+	fmt.Printf("Removed %d cached token(s). Refresh tokens already issued stay valid until they expire or your sessions are revoked in Azure AD.\n", removed)
+	return nil
+}
+
+// removeCachedTokens deletes the token caches of an account and tenant in
+// every cloud. An empty account or tenant matches all of them.
+func removeCachedTokens(account, tenantID string) (int, error) {
+	unlock, err := lockTokenCache()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	files, err := listCachedTokenFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, f := range files {
+		if tenantID != "" && !strings.EqualFold(f.TenantID, tenantID) {
+			continue
+		}
+
+		if account != "" && f.Account != account {
+			continue
+		}
+
+		if err := os.Remove(f.Path); err != nil {
+			return removed, fmt.Errorf("Failed to remove %s: %v", f.Path, err)
+		}
+		removed++
+
+		if f.Account != "" {
+			// Drop the account directory once its last cache is gone
+			os.Remove(filepath.Dir(f.Path))
+		}
+	}
+
+	return removed, nil
+}
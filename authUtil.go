@@ -2,32 +2,26 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
 	"os/user"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Azure/go-autorest/autorest/adal"
+	jwt "github.com/dgrijalva/jwt-go"
 )
 
 const (
-	activeDirectoryEndpoint = "https://login.microsoftonline.com/"
-	armResource             = "https://management.core.windows.net/"
-	clientAppID             = "aebc6443-996d-45c2-90f0-388ff96faa56"
-	commonTenant            = "common"
-)
+	clientAppID  = "aebc6443-996d-45c2-90f0-388ff96faa56"
+	commonTenant = "common"
 
-type responseJSON struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	Resource     string `json:"resource"`
-	TokenType    string `json:"token_type"`
-}
+	// cloudTenantSeparator cannot appear in a tenant or a cloud host name
+	cloudTenantSeparator = "@"
+)
 
 type tenant struct {
 	ID          string `json:"id"`
@@ -40,19 +34,40 @@ type tenantList struct {
 	Value []tenant `json:"value"`
 }
 
+// defaultTokenCachePath is the token cache of the tenant for the active
+// account, or the legacy per-tenant cache when no account is known yet.
 func defaultTokenCachePath(tenant string) string {
+	if activeCloud.Name != azurePublicCloud.Name {
+		tenant = activeCloud.Name + cloudTenantSeparator + tenant
+	}
+
+	dir := tokenCacheDir()
+	if activeAccount != "" {
+		dir = accountCacheDir(activeAccount)
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("accessToken.%s.json", strings.ToLower(tenant)))
+}
+
+// lockTokenCache locks the token caches of all accounts and tenants. One lock
+// covers them all, saving a token may switch the active account and with it
+// the file the token is written to.
+func lockTokenCache() (func(), error) {
+	return lockFile(filepath.Join(tokenCacheDir(), "accessToken"))
+}
+
+func tokenCacheDir() string {
 	usr, err := user.Current()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return fmt.Sprintf("%s/.azshell/accessToken.%s.json", usr.HomeDir, strings.ToLower(tenant))
+	return filepath.Join(usr.HomeDir, ".azshell")
 }
 
 func acquireTokenDeviceCodeFlow(oauthConfig adal.OAuthConfig,
 	applicationID string,
-	resource string,
-	callbacks ...adal.TokenRefreshCallback) (*adal.ServicePrincipalToken, error) {
+	resource string) (*adal.ServicePrincipalToken, error) {
 
 	oauthClient := &http.Client{}
 	deviceCode, err := adal.InitiateDeviceAuth(
@@ -64,9 +79,30 @@ func acquireTokenDeviceCodeFlow(oauthConfig adal.OAuthConfig,
 		return nil, fmt.Errorf("Failed to start device auth flow: %s", err)
 	}
 
-	fmt.Println(*deviceCode.Message)
+	prompt := deviceCodePrompt{}
+	if deviceCode.UserCode != nil && deviceCode.VerificationURL != nil && deviceCode.Message != nil && deviceCode.ExpiresIn != nil {
+		prompt = deviceCodePrompt{*deviceCode.UserCode, *deviceCode.VerificationURL, *deviceCode.Message, *deviceCode.ExpiresIn}
+	}
+	showDeviceCode(prompt)
 
-	token, err := adal.WaitForUserCompletion(oauthClient, deviceCode)
+	var interval, expiresIn time.Duration
+	if deviceCode.Interval != nil {
+		interval = time.Duration(*deviceCode.Interval) * time.Second
+	}
+	if deviceCode.ExpiresIn != nil {
+		expiresIn = time.Duration(*deviceCode.ExpiresIn) * time.Second
+	}
+
+	token, err := waitForDeviceCode(interval, expiresIn, func() (*adal.Token, error) {
+		token, err := adal.CheckForUserCompletion(oauthClient, deviceCode)
+		switch err {
+		case adal.ErrDeviceAuthorizationPending:
+			return nil, errDeviceCodePending
+		case adal.ErrDeviceSlowDown:
+			return nil, errDeviceCodeSlowDown
+		}
+		return token, err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("Failed to finish device auth flow: %s", err)
 	}
@@ -75,36 +111,33 @@ func acquireTokenDeviceCodeFlow(oauthConfig adal.OAuthConfig,
 		oauthConfig,
 		applicationID,
 		resource,
-		*token,
-		callbacks...)
+		*token)
 	return spt, err
 }
 
-func refreshToken(oauthConfig adal.OAuthConfig,
-	applicationID string,
-	resource string,
-	tokenCachePath string,
-	callbacks ...adal.TokenRefreshCallback) (*adal.ServicePrincipalToken, error) {
-
-	token, err := adal.LoadToken(tokenCachePath)
+// refreshToken redeems the refresh token cached at tokenCachePath for a token
+// of the resource in the tenant.
+func refreshToken(tenantID string, resource string, tokenCachePath string) (*adal.Token, error) {
+	token, err := loadTokenFile(tokenCachePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load token from cache: %v", err)
 	}
 
-	spt, err := adal.NewServicePrincipalTokenFromManualToken(
-		oauthConfig,
-		applicationID,
-		resource,
-		*token,
-		callbacks...)
-	if err != nil {
-		return nil, err
-	}
-	return spt, spt.Refresh()
+	return redeemRefreshToken(tenantID, resource, token.RefreshToken)
 }
 
+// saveToken caches the token under the account it was issued to, which
+// becomes the active account.
 func saveToken(spt adal.Token, tenant string) error {
-	err := adal.SaveToken(defaultTokenCachePath(tenant), 0600, spt)
+	if account := tokenAccount(spt); account != "" && account != activeAccount {
+		if activeAccount != "" {
+			log.Printf("Signed in as %s instead of %s.", account, activeAccount)
+		}
+
+		activeAccount = account
+	}
+
+	err := saveTokenFile(defaultTokenCachePath(tenant), spt)
 	if err != nil {
 		return err
 	}
@@ -127,122 +160,33 @@ func getTenants(commonTenantToken string) (ret []tenant, e error) {
 
 	response, err := client.Do(req)
 	if err != nil {
-		return nil, errors.New("Failed to list tenants: " + err.Error())
+		return nil, newError(tenantFailure, err, "Failed to list tenants")
 	}
 
 	defer response.Body.Close()
 	buf, err := ioutil.ReadAll(response.Body)
-
-	var tenants tenantList
-	json.Unmarshal(buf, &tenants)
-
-	return tenants.Value, nil
-}
-
-func acquireAuthTokenDeviceFlow(tenantID string) (string, error) {
-	oauthConfig, err := adal.NewOAuthConfig(activeDirectoryEndpoint, tenantID)
 	if err != nil {
-		panic(err)
+		return nil, newError(tenantFailure, err, "Failed to list tenants")
 	}
 
-	callback := func(token adal.Token) error {
-		return saveToken(token, tenantID)
+	if response.StatusCode != http.StatusOK {
+		return nil, newError(tenantFailure, responseError(response, buf), "Failed to list tenants")
 	}
 
-	if _, err := os.Stat(defaultTokenCachePath(tenantID)); err == nil {
-		token, err := adal.LoadToken(defaultTokenCachePath(tenantID))
-		if err != nil {
-			return "", err
-		}
-
-		var spt *adal.ServicePrincipalToken
-		if token.IsExpired() {
-			spt, err = refreshToken(*oauthConfig, clientAppID, armResource, defaultTokenCachePath(tenantID), callback)
-			if err == nil {
-				return fmt.Sprintf("%s %s", spt.Token().Type, spt.Token().AccessToken), nil
-			}
-		} else {
-			return fmt.Sprintf("%s %s", token.Type, token.AccessToken), nil
-		}
-	}
-
-	if tenantID != commonTenant {
-		_, err := acquireAuthTokenDeviceFlow(commonTenant)
-		if err != nil {
-			return "", err
-		}
-
-		spt, err := refreshToken(*oauthConfig, clientAppID, armResource, defaultTokenCachePath(commonTenant), callback)
-		if err != nil {
-			return "", err
-		}
-
-		return fmt.Sprintf("%s %s", spt.Token().Type, spt.Token().AccessToken), nil
-	}
-
-	var spt *adal.ServicePrincipalToken
-	spt, err = acquireTokenDeviceCodeFlow(
-		*oauthConfig,
-		clientAppID,
-		armResource,
-		callback)
-
-	if err == nil {
-		saveToken(spt.Token(), tenantID)
+	var tenants tenantList
+	if err := json.Unmarshal(buf, &tenants); err != nil {
+		return nil, newError(tenantFailure, err, "Failed to parse tenants")
 	}
 
-	return fmt.Sprintf("%s %s", spt.Token().Type, spt.Token().AccessToken), nil
+	return tenants.Value, nil
 }
 
-func acquireAuthTokenMSI(endpoint string) (string, error) {
-	msiendpoint, _ := url.Parse(endpoint)
-
-	parameters := url.Values{}
-	parameters.Add("resource", armResource)
-
-	msiendpoint.RawQuery = parameters.Encode()
-
-	req, err := http.NewRequest("GET", msiendpoint.String(), nil)
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Add("Metadata", "true")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-
-	responseBytes, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	if err != nil {
-		return "", err
-	}
-
-	var r responseJSON
-	err = json.Unmarshal(responseBytes, &r)
-	if err != nil {
-		return "", err
-	}
-
-	return r.TokenType + " " + r.AccessToken, nil
+func authorizationHeader(token adal.Token) string {
+	return fmt.Sprintf("%s %s", token.Type, token.AccessToken)
 }
 
 func acquireBootstrapToken() (string, error) {
-	endpoint, hasMsiEndpoint := os.LookupEnv("MSI_ENDPOINT")
-
-	if hasMsiEndpoint {
-		token, err := acquireAuthTokenMSI(endpoint)
-		if err != nil {
-			return "", err
-		}
-
-		return token, nil
-	}
-
-	return acquireAuthTokenDeviceFlow(commonTenant)
+	return credentials.Token(commonTenant, activeCloud.ResourceManagerAudience)
 }
 
 func acquireAuthTokenCurrentTenant() (string, error) {
@@ -260,41 +204,37 @@ func acquireAuthTokenCurrentTenant() (string, error) {
 
 		tenants, err := getTenants(token)
 		if err != nil {
-			return "", errors.New("Failed to list tenants: " + err.Error())
+			return "", err
 		}
 
 		if len(tenants) == 0 {
-			return "", fmt.Errorf("You don't have access to any tenants (directory)")
+			return "", newError(tenantFailure, nil, "You don't have access to any tenants (directory)")
 		}
 
-		userSettings.ActiveTenant = tenants[0].TenantID
 		tenantID = tenants[0].TenantID
-		saveSettings(userSettings)
+		updateSettings(func(s *settings) { s.ActiveTenant = tenantID })
 	}
 
-	return acquireAuthToken(tenantID)
+	return credentials.Token(tenantID, activeCloud.ResourceManagerAudience)
 }
 
-func acquireAuthToken(tenantID string) (string, error) {
-	endpoint, hasMsiEndpoint := os.LookupEnv("MSI_ENDPOINT")
-
-	if hasMsiEndpoint {
-		token, err := acquireAuthTokenMSI(endpoint)
-		if err != nil {
-			return "", err
-		}
-
-		return token, nil
+// parseTokenClaims decodes the claims of a JWT access token without verifying its signature
+func parseTokenClaims(accessToken string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(accessToken, claims); err != nil {
+		return nil, err
 	}
 
-	if tenantID == "" {
-		panic(fmt.Errorf("Tenant ID required for acquire token"))
-	}
+	return claims, nil
+}
 
-	token, err := acquireAuthTokenDeviceFlow(tenantID)
-	if err != nil {
-		log.Println("Failed to login to tenant: ", tenantID)
+// claimString returns the first non-empty string claim of the given names
+func claimString(claims jwt.MapClaims, names ...string) string {
+	for _, n := range names {
+		if v, ok := claims[n].(string); ok && v != "" {
+			return v
+		}
 	}
 
-	return token, nil
+	return ""
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	autoLocation = "auto"
+
+	autoLocationTTL     = 24 * time.Hour
+	latencyProbeTimeout = 3 * time.Second
+	latencyProbeSamples = 3
+)
+
+// cloudShellRegions are the regions Cloud Shell runs in, per cloud
+var cloudShellRegions = map[string][]string{
+	azurePublicCloud.Name: {
+		"eastus", "southcentralus", "westus", "westcentralus",
+		"northeurope", "westeurope", "centralindia", "southeastasia",
+	},
+	azureUSGovernmentCloud.Name: {"usgovvirginia", "usgovarizona"},
+}
+
+// locationCache is the result of the last latency measurement, saved in the settings
+type locationCache struct {
+	Cloud     string    `json:"cloud"`
+	Locations []string  `json:"locations"`
+	Measured  time.Time `json:"measured"`
+}
+
+type regionLatency struct {
+	Region  string
+	Latency time.Duration
+}
+
+// isAutoLocation tells if --location asks for the lowest-latency region
+func isAutoLocation(locations []string) bool {
+	return len(locations) == 1 && locations[0] == autoLocation
+}
+
+// autoLocations returns the Cloud Shell regions of the active cloud, fastest
+// first, so slower regions serve as failover. The order is measured once per
+// autoLocationTTL and cached in the settings.
+func autoLocations() ([]string, error) {
+	s, err := readSettings()
+	if err == nil && s.Locations != nil && s.Locations.Cloud == activeCloud.Name &&
+		len(s.Locations.Locations) > 0 && time.Since(s.Locations.Measured) < autoLocationTTL {
+		return s.Locations.Locations, nil
+	}
+
+	regions, ok := cloudShellRegions[activeCloud.Name]
+	if !ok {
+		return nil, fmt.Errorf("--location %s is not supported in cloud %s, specify the region", autoLocation, activeCloud.Name)
+	}
+
+	log.Printf("Measuring latency to Cloud Shell regions...")
+	latencies := measureRegions(regions)
+	if len(latencies) == 0 {
+		return nil, fmt.Errorf("none of the Cloud Shell regions could be reached")
+	}
+
+	locations := []string{}
+	for _, l := range latencies {
+		locations = append(locations, l.Region)
+	}
+	log.Printf("Fastest Cloud Shell region is %s (%v)", latencies[0].Region, latencies[0].Latency.Round(time.Millisecond))
+
+	cache := &locationCache{Cloud: activeCloud.Name, Locations: locations, Measured: time.Now()}
+	if err := updateSettings(func(s *settings) { s.Locations = cache }); err != nil {
+		log.Printf("Failed to save the measured regions: %v", err)
+	}
+
+	return locations, nil
+}
+
+// measureRegions measures the regions concurrently and returns the reachable
+// ones sorted by latency
+func measureRegions(regions []string) []regionLatency {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	latencies := []regionLatency{}
+
+	for _, region := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+
+			latency, err := measureLatency(region + "." + activeCloud.resourceManagerHost())
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			latencies = append(latencies, regionLatency{region, latency})
+			mu.Unlock()
+		}(region)
+	}
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i].Latency < latencies[j].Latency })
+	return latencies
+}
+
+// measureLatency returns the fastest of a few TCP connects and TLS handshakes
+// to the regional Resource Manager endpoint, which runs next to Cloud Shell
+func measureLatency(host string) (time.Duration, error) {
+	var best time.Duration
+	var lastErr error
+
+	for i := 0; i < latencyProbeSamples; i++ {
+		start := time.Now()
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: latencyProbeTimeout}, "tcp", host+":443", &tls.Config{ServerName: host})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		elapsed := time.Since(start)
+		conn.Close()
+
+		if best == 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+
+	if best == 0 {
+		return 0, fmt.Errorf("%s: %v", host, lastErr)
+	}
+
+	return best, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/manifoldco/promptui"
+)
+
+const (
+	azCliClientID        = "04b07795-8ddb-461a-bbee-02f9e1bf7b46"
+	azCliConfigDirEnvVar = "AZURE_CONFIG_DIR"
+)
+
+// azCliAccount is a user signed in with the Azure CLI
+type azCliAccount struct {
+	Username     string
+	TenantID     string
+	RefreshToken string
+}
+
+// adalTokenEntry is an entry of the legacy accessTokens.json
+type adalTokenEntry struct {
+	UserID       string `json:"userId"`
+	RefreshToken string `json:"refreshToken"`
+	Authority    string `json:"_authority"`
+}
+
+// msalTokenCache is the subset of msal_token_cache.json azshell reads
+type msalTokenCache struct {
+	RefreshToken map[string]struct {
+		HomeAccountID string `json:"home_account_id"`
+		ClientID      string `json:"client_id"`
+		FamilyID      string `json:"family_id"`
+		Secret        string `json:"secret"`
+	} `json:"RefreshToken"`
+	Account map[string]struct {
+		HomeAccountID string `json:"home_account_id"`
+		Username      string `json:"username"`
+	} `json:"Account"`
+}
+
+func azCliConfigDir() string {
+	if dir := os.Getenv(azCliConfigDirEnvVar); dir != "" {
+		return dir
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(usr.HomeDir, ".azure")
+}
+
+// readAzCliAccounts lists the accounts with a refresh token in the Azure CLI
+// MSAL cache and the legacy ADAL accessTokens.json.
+func readAzCliAccounts() ([]azCliAccount, error) {
+	dir := azCliConfigDir()
+	accounts := []azCliAccount{}
+	seen := map[string]bool{}
+
+	add := func(a azCliAccount) {
+		key := strings.ToLower(a.Username + "/" + a.TenantID)
+		if a.RefreshToken == "" || seen[key] {
+			return
+		}
+
+		seen[key] = true
+		accounts = append(accounts, a)
+	}
+
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "msal_token_cache.json")); err == nil {
+		var cache msalTokenCache
+		if err := json.Unmarshal(buf, &cache); err != nil {
+			return nil, fmt.Errorf("failed to parse Azure CLI MSAL token cache: %v", err)
+		}
+
+		usernames := map[string]string{}
+		for _, a := range cache.Account {
+			usernames[a.HomeAccountID] = a.Username
+		}
+
+		for _, rt := range cache.RefreshToken {
+			if rt.ClientID != azCliClientID && rt.FamilyID != "1" {
+				continue
+			}
+
+			// home_account_id is "<object id>.<home tenant id>"
+			tenantID := rt.HomeAccountID[strings.LastIndex(rt.HomeAccountID, ".")+1:]
+			add(azCliAccount{Username: usernames[rt.HomeAccountID], TenantID: tenantID, RefreshToken: rt.Secret})
+		}
+	}
+
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "accessTokens.json")); err == nil {
+		var entries []adalTokenEntry
+		if err := json.Unmarshal(buf, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse Azure CLI accessTokens.json: %v", err)
+		}
+
+		for _, e := range entries {
+			tenantID := e.Authority[strings.LastIndex(e.Authority, "/")+1:]
+			add(azCliAccount{Username: e.UserID, TenantID: tenantID, RefreshToken: e.RefreshToken})
+		}
+	}
+
+	sort.SliceStable(accounts, func(i, j int) bool {
+		return strings.ToLower(accounts[i].Username) < strings.ToLower(accounts[j].Username)
+	})
+
+	return accounts, nil
+}
+
+// redeemAzCliRefreshToken exchanges an Azure CLI refresh token for an azshell
+// token of tenantID and caches it. Both clients belong to the same family of
+// first party apps, so the refresh token can be redeemed by azshell.
+func redeemAzCliRefreshToken(account azCliAccount, tenantID string) (*adal.Token, error) {
+	token, err := redeemRefreshToken(tenantID, activeCloud.ResourceManagerAudience, account.RefreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem Azure CLI login of %s: %v", account.Username, err)
+	}
+
+	if err := saveToken(*token, tenantID); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// importAzCliLogin copies the refresh token of an Azure CLI account into the azshell cache
+func importAzCliLogin(username string) error {
+	accounts, err := readAzCliAccounts()
+	if err != nil {
+		return err
+	}
+
+	if username != "" {
+		matches := []azCliAccount{}
+		for _, a := range accounts {
+			if strings.EqualFold(a.Username, username) {
+				matches = append(matches, a)
+			}
+		}
+		accounts = matches
+	}
+
+	if len(accounts) == 0 {
+		return fmt.Errorf("No Azure CLI login found in %s. Run 'az login' first.", azCliConfigDir())
+	}
+
+	account := accounts[0]
+	if len(accounts) > 1 {
+		options := []string{}
+		for _, a := range accounts {
+			options = append(options, fmt.Sprintf("%s (%s)", a.Username, a.TenantID))
+		}
+
+		prompt := promptui.Select{
+			Label: "Select Azure CLI Account",
+			Items: options,
+		}
+
+		index, _, err := prompt.Run()
+		if err != nil {
+			return newError(usageFailure, nil, "Specify the --account option since multiple Azure CLI accounts are available.")
+		}
+
+		account = accounts[index]
+	}
+
+	if _, err := redeemAzCliRefreshToken(account, commonTenant); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported Azure CLI login of %s.\n", account.Username)
+	return nil
+}
+
+// azCliTokenProvider reuses the login of the Azure CLI, so users signed in
+// with 'az login' do not have to sign in again.
+type azCliTokenProvider struct{}
+
+func (p *azCliTokenProvider) Name() string {
+	return "azcli"
+}
+
+func (p *azCliTokenProvider) Token(tenantID, resource string) (string, error) {
+	if resource != activeCloud.ResourceManagerAudience {
+		return "", credentialUnavailable("Azure CLI logins are imported for Resource Manager only")
+	}
+
+	accounts, err := readAzCliAccounts()
+	if err != nil || len(accounts) == 0 {
+		return "", credentialUnavailable("no Azure CLI login found in %s", azCliConfigDir())
+	}
+
+	if activeAccount != "" {
+		matches := []azCliAccount{}
+		for _, a := range accounts {
+			if accountName(a.Username) == activeAccount {
+				matches = append(matches, a)
+			}
+		}
+
+		if len(matches) == 0 {
+			return "", credentialUnavailable("no Azure CLI login of %s", activeAccount)
+		}
+		accounts = matches
+	} else {
+		// Never pick one of several users silently, the shell would run as the wrong identity
+		for _, a := range accounts {
+			if !strings.EqualFold(a.Username, accounts[0].Username) {
+				return "", credentialUnavailable("several Azure CLI accounts are signed in, specify the --account option")
+			}
+		}
+	}
+
+	account := accounts[0]
+	for _, a := range accounts {
+		if strings.EqualFold(a.TenantID, tenantID) {
+			account = a
+			break
+		}
+	}
+
+	token, err := redeemAzCliRefreshToken(account, tenantID)
+	if err != nil {
+		return "", credentialUnavailable("%v", err)
+	}
+
+	return authorizationHeader(*token), nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+const browserLoginTimeout = 5 * time.Minute
+
+// browserTokenProvider signs the user in with the authorization code flow and
+// PKCE, receiving the code on a local loopback redirect.
+type browserTokenProvider struct{}
+
+func (p *browserTokenProvider) Name() string {
+	return "browser"
+}
+
+func (p *browserTokenProvider) Interactive() bool {
+	return true
+}
+
+func (p *browserTokenProvider) Token(tenantID, resource string) (string, error) {
+	if resource != activeCloud.ResourceManagerAudience {
+		return interactiveResourceToken(p, tenantID, resource)
+	}
+
+	if tenantID != commonTenant {
+		if _, err := p.Token(commonTenant, resource); err != nil {
+			return "", err
+		}
+
+		return redeemCommonRefreshToken(tenantID)
+	}
+
+	token, err := acquireTokenAuthCodeFlow(tenantID, activeCloud.ResourceManagerAudience, "")
+	if err != nil {
+		return "", err
+	}
+
+	if err := saveToken(*token, tenantID); err != nil {
+		return "", err
+	}
+
+	return authorizationHeader(*token), nil
+}
+
+func (p *browserTokenProvider) TokenWithClaims(tenantID, claims string) (string, error) {
+	token, err := acquireTokenAuthCodeFlow(tenantID, activeCloud.ResourceManagerAudience, claims)
+	if err != nil {
+		return "", err
+	}
+
+	if err := saveToken(*token, tenantID); err != nil {
+		return "", err
+	}
+
+	return authorizationHeader(*token), nil
+}
+
+type authCodeResult struct {
+	code string
+	err  error
+}
+
+func acquireTokenAuthCodeFlow(tenantID, resource, claims string) (*adal.Token, error) {
+	verifier, err := randomURLSafeString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := randomURLSafeString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	listeners, err := listenLocalhost()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start local listener for login: %v", err)
+	}
+	for _, l := range listeners {
+		defer l.Close()
+	}
+
+	redirectURI := fmt.Sprintf("http://localhost:%d/", listeners[0].Addr().(*net.TCPAddr).Port)
+
+	results := make(chan authCodeResult, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			result := authCodeResult{code: query.Get("code")}
+
+			// Anything else than the login response, e.g. a favicon request
+			if result.code == "" && query.Get("error") == "" {
+				http.NotFound(w, r)
+				return
+			}
+
+			switch {
+			case query.Get("state") != state:
+				result.err = fmt.Errorf("state mismatch in login response")
+			case query.Get("error") != "":
+				result.err = fmt.Errorf("%s: %s", query.Get("error"), query.Get("error_description"))
+			}
+
+			if result.err != nil {
+				fmt.Fprintf(w, "Login failed: %v", result.err)
+			} else {
+				fmt.Fprint(w, "Login succeeded. You can close this window and return to azshell.")
+			}
+
+			select {
+			case results <- result:
+			default:
+			}
+		}),
+	}
+	for _, l := range listeners {
+		go server.Serve(l)
+	}
+	defer server.Close()
+
+	parameters := url.Values{}
+	parameters.Add("client_id", clientAppID)
+	parameters.Add("response_type", "code")
+	parameters.Add("redirect_uri", redirectURI)
+	parameters.Add("state", state)
+	parameters.Add("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	parameters.Add("code_challenge_method", "S256")
+	parameters.Add("prompt", "select_account")
+	setResource(parameters, resource, claims)
+
+	authorizeURL := oauthEndpoint(tenantID, "authorize") + "?" + parameters.Encode()
+
+	fmt.Printf("Opening a browser to sign in. If it does not open, navigate to:\n%s\n", authorizeURL)
+	openBrowser(authorizeURL)
+
+	var result authCodeResult
+	select {
+	case result = <-results:
+	case <-time.After(browserLoginTimeout):
+		return nil, fmt.Errorf("Timed out waiting for browser login after %v", browserLoginTimeout)
+	}
+
+	if result.err != nil {
+		return nil, fmt.Errorf("Failed to finish browser login: %v", result.err)
+	}
+
+	return redeemAuthorizationCode(tenantID, resource, claims, result.code, redirectURI, verifier)
+}
+
+// listenLocalhost listens on a free port of both loopback addresses, the
+// browser may resolve localhost in the redirect URI to either of them. IPv6
+// is skipped where it is not available.
+func listenLocalhost() ([]net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := []net.Listener{l}
+	if l6, err := net.Listen("tcp", fmt.Sprintf("[::1]:%d", l.Addr().(*net.TCPAddr).Port)); err == nil {
+		listeners = append(listeners, l6)
+	}
+
+	return listeners, nil
+}
+
+func redeemAuthorizationCode(tenantID, resource, claims, code, redirectURI, verifier string) (*adal.Token, error) {
+	parameters := url.Values{}
+	parameters.Add("grant_type", "authorization_code")
+	parameters.Add("code", code)
+	parameters.Add("redirect_uri", redirectURI)
+	parameters.Add("code_verifier", verifier)
+	setResource(parameters, resource, claims)
+
+	token, err := postTokenRequest(tenantID, parameters, resource)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to redeem authorization code: %v", err)
+	}
+
+	return token, nil
+}
+
+func randomURLSafeString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var challengeParameterPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// claimsChallengeProvider is implemented by the interactive providers, which
+// can sign the user in again with the claims a conditional access policy asks for.
+type claimsChallengeProvider interface {
+	TokenWithClaims(tenantID, claims string) (string, error)
+}
+
+// parseClaimsChallenge returns the claims of an insufficient_claims challenge
+// in the WWW-Authenticate header of a 401 response.
+func parseClaimsChallenge(response *http.Response) (string, bool) {
+	if response.StatusCode != http.StatusUnauthorized {
+		return "", false
+	}
+
+	for _, header := range response.Header[http.CanonicalHeaderKey("WWW-Authenticate")] {
+		parameters := map[string]string{}
+		for _, m := range challengeParameterPattern.FindAllStringSubmatch(header, -1) {
+			parameters[strings.ToLower(m[1])] = m[2]
+		}
+
+		if parameters["error"] != "insufficient_claims" || parameters["claims"] == "" {
+			continue
+		}
+
+		for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+			if claims, err := encoding.DecodeString(parameters["claims"]); err == nil {
+				return string(claims), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// answerClaimsChallenge signs the user in to the tenant again with the first
+// interactive method of the chain that handles claims, and returns the new token.
+func answerClaimsChallenge(tenantID, claims string) (string, error) {
+	chain, ok := credentials.(*tokenProviderChain)
+	if !ok {
+		return "", fmt.Errorf("additional authentication is required, run 'azshell login' to sign in again")
+	}
+
+	for _, p := range chain.providers {
+		if c, ok := p.(claimsChallengeProvider); ok {
+			log.Printf("Additional authentication is required by a conditional access policy, signing in again with %s...", p.Name())
+			return c.TokenWithClaims(tenantID, claims)
+		}
+	}
+
+	return "", fmt.Errorf("additional authentication is required by a conditional access policy, but no interactive authentication method (devicecode, browser) is enabled")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+const testClaims = `{"access_token":{"acrs":{"essential":true,"value":"c1"}}}`
+
+var claimsChallengeTests = []struct {
+	status     int
+	challenges []string
+	claims     string
+	ok         bool
+}{
+	{
+		status:     http.StatusUnauthorized,
+		challenges: []string{`Bearer authorization_uri="https://login.microsoftonline.com/common/oauth2/authorize", error="insufficient_claims", claims="` + base64.StdEncoding.EncodeToString([]byte(testClaims)) + `"`},
+		claims:     testClaims,
+		ok:         true,
+	},
+	{
+		// Unpadded base64 as sent by some services
+		status:     http.StatusUnauthorized,
+		challenges: []string{`Bearer error="insufficient_claims", claims="` + base64.RawStdEncoding.EncodeToString([]byte(testClaims)) + `"`},
+		claims:     testClaims,
+		ok:         true,
+	},
+	{
+		// The claims challenge is not the first WWW-Authenticate header
+		status:     http.StatusUnauthorized,
+		challenges: []string{`Basic realm="azure"`, `Bearer Error="insufficient_claims", Claims="` + base64.StdEncoding.EncodeToString([]byte(testClaims)) + `"`},
+		claims:     testClaims,
+		ok:         true,
+	},
+	{
+		status:     http.StatusUnauthorized,
+		challenges: []string{`Bearer error="invalid_token", error_description="The access token expired"`},
+	},
+	{
+		status:     http.StatusUnauthorized,
+		challenges: []string{`Bearer error="insufficient_claims", claims="not base64!"`},
+	},
+	{
+		status:     http.StatusForbidden,
+		challenges: []string{`Bearer error="insufficient_claims", claims="` + base64.StdEncoding.EncodeToString([]byte(testClaims)) + `"`},
+	},
+	{
+		status: http.StatusUnauthorized,
+	},
+}
+
+func TestParseClaimsChallenge(t *testing.T) {
+	for _, test := range claimsChallengeTests {
+		response := &http.Response{StatusCode: test.status, Header: http.Header{}}
+		for _, c := range test.challenges {
+			response.Header.Add("WWW-Authenticate", c)
+		}
+
+		claims, ok := parseClaimsChallenge(response)
+		if claims != test.claims || ok != test.ok {
+			t.Errorf("parseClaimsChallenge(%d %q) = %q, %v, want %q, %v", test.status, test.challenges, claims, ok, test.claims, test.ok)
+		}
+	}
+}
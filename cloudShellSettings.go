@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/manifoldco/promptui"
+)
+
+var (
+	locationPattern       = regexp.MustCompile(`^[a-z0-9]+$`)
+	storageAccountPattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Storage/storageAccounts/[a-z0-9]{3,24}$`)
+)
+
+// rawUserSettings keeps all properties of the cloudconsole user settings, so
+// a read-modify-write does not drop the ones azshell does not know about
+type rawUserSettings struct {
+	Properties map[string]interface{} `json:"properties"`
+}
+
+func runSettings(args []string) error {
+	if len(args) == 0 {
+		return newError(usageFailure, nil, "Usage: %s settings show|set|delete", os.Args[0])
+	}
+
+	switch args[0] {
+	case "show":
+		return runSettingsShow(args[1:])
+	case "set":
+		return runSettingsSet(args[1:])
+	case "delete":
+		return runSettingsDelete(args[1:])
+	default:
+		return newError(usageFailure, nil, "Unknown settings command '%s', use show, set or delete", args[0])
+	}
+}
+
+func runSettingsShow(args []string) error {
+	var authMethods, tenantID, output string
+
+	fs := flag.NewFlagSet("settings show", flag.ExitOnError)
+	fs.StringVar(&tenantID, "tenant", "", "Tenant of the Cloud Shell settings (default the active tenant).")
+	fs.StringVar(&output, "output", "table", "Output format, table or json.")
+	addAuthFlags(fs, &authMethods)
+	fs.Parse(args)
+
+	if err := validateSettingsOutput(output); err != nil {
+		return err
+	}
+
+	tenantID, err := settingsTenant(tenantID, authMethods)
+	if err != nil {
+		return err
+	}
+
+	css, err := ReadCloudShellUserSettings(tenantID)
+	if err != nil {
+		return err
+	}
+
+	return printUserSettings(css, output)
+}
+
+func runSettingsSet(args []string) error {
+	var authMethods, tenantID, output, shell, location, storageAccount, fileShare string
+
+	fs := flag.NewFlagSet("settings set", flag.ExitOnError)
+	fs.StringVar(&tenantID, "tenant", "", "Tenant of the Cloud Shell settings (default the active tenant).")
+	fs.StringVar(&output, "output", "table", "Output format, table or json.")
+	fs.StringVar(&shell, "shell", "", "Preferred shell, bash or pwsh.")
+	fs.StringVar(&location, "location", "", "Preferred Cloud Shell region, e.g. westeurope.")
+	fs.StringVar(&storageAccount, "storage-account", "", "Resource Id of the storage account of the home directory.")
+	fs.StringVar(&fileShare, "file-share", "", "File share of the home directory in the storage account.")
+	addAuthFlags(fs, &authMethods)
+	fs.Parse(args)
+
+	if err := validateSettingsOutput(output); err != nil {
+		return err
+	}
+
+	if shell == "" && location == "" && storageAccount == "" && fileShare == "" {
+		return newError(usageFailure, nil, "Specify at least one of --shell, --location, --storage-account or --file-share")
+	}
+
+	if shell != "" && shell != "bash" && shell != "pwsh" {
+		return newError(usageFailure, nil, "Unknown shell '%s', use bash or pwsh", shell)
+	}
+
+	location = strings.ToLower(strings.Replace(location, " ", "", -1))
+	if location != "" && !locationPattern.MatchString(location) {
+		return newError(usageFailure, nil, "Invalid location '%s', use a region name such as westeurope", location)
+	}
+
+	if storageAccount != "" && !storageAccountPattern.MatchString(storageAccount) {
+		return newError(usageFailure, nil, "Invalid storage account '%s', use its resource Id /subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Storage/storageAccounts/<name>", storageAccount)
+	}
+
+	if storageAccount != "" && fileShare == "" {
+		return newError(usageFailure, nil, "Specify --file-share with --storage-account")
+	}
+
+	if fileShare != "" && !fileShareNamePattern.MatchString(fileShare) {
+		return newError(usageFailure, nil, "Invalid file share name '%s'", fileShare)
+	}
+
+	tenantID, err := settingsTenant(tenantID, authMethods)
+	if err != nil {
+		return err
+	}
+
+	s, err := readRawUserSettings(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if shell != "" {
+		s.Properties["preferredShellType"] = shell
+	}
+
+	if location != "" {
+		s.Properties["preferredLocation"] = location
+	}
+
+	if fileShare != "" {
+		profile, _ := s.Properties["storageProfile"].(map[string]interface{})
+		if profile == nil {
+			profile = map[string]interface{}{"diskSizeInGB": cloudShellDiskSizeGiB}
+		}
+
+		if storageAccount != "" {
+			profile["storageAccountResourceId"] = storageAccount
+		}
+
+		account, _ := profile["storageAccountResourceId"].(string)
+		if account == "" {
+			return newError(usageFailure, nil, "Specify --storage-account, Cloud Shell has no storage account yet")
+		}
+
+		// Catch typos here, Cloud Shell only fails when the console mounts the share
+		if _, err := sendRequest(tenantID, "GET", resourceURL(account+"/fileServices/default/shares/"+fileShare, storageAPIVersion), nil); err != nil {
+			return newError(usageFailure, err, "File share %s not found in %s", fileShare, account)
+		}
+
+		profile["fileShareName"] = fileShare
+		s.Properties["storageProfile"] = profile
+	}
+
+	if s.Properties["storageProfile"] == nil {
+		return newError(notSetUpFailure, nil, "Cloud Shell is not set up. Run '%s setup' or specify --storage-account and --file-share", os.Args[0])
+	}
+
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	buf, err = sendRequest(tenantID, "PUT", activeCloud.ResourceManagerEndpoint+userSettingsPath, buf)
+	if err != nil {
+		return newError(provisioningFailure, err, "Failed to save Cloud Shell settings")
+	}
+
+	css := CloudShellSettings{}
+	if err := json.Unmarshal(buf, &css); err != nil {
+		return newError(provisioningFailure, err, "Failed to parse user settings")
+	}
+
+	return printUserSettings(&css, output)
+}
+
+func runSettingsDelete(args []string) error {
+	var authMethods, tenantID string
+	var yes bool
+
+	fs := flag.NewFlagSet("settings delete", flag.ExitOnError)
+	fs.StringVar(&tenantID, "tenant", "", "Tenant of the Cloud Shell settings (default the active tenant).")
+	fs.BoolVar(&yes, "yes", false, "Do not ask for confirmation.")
+	addAuthFlags(fs, &authMethods)
+	fs.Parse(args)
+
+	tenantID, err := settingsTenant(tenantID, authMethods)
+	if err != nil {
+		return err
+	}
+
+	if !yes {
+		prompt := promptui.Prompt{
+			Label:     fmt.Sprintf("Delete the Cloud Shell settings of tenant %s? The storage account and file share are kept", tenantID),
+			IsConfirm: true,
+		}
+
+		if _, err := prompt.Run(); err != nil {
+			return newError(usageFailure, nil, "Cancelled, specify --yes to delete without confirmation")
+		}
+	}
+
+	// The running console still uses the old settings, end it first
+	for _, path := range []string{consolePath, userSettingsPath} {
+		_, err := sendRequest(tenantID, "DELETE", activeCloud.ResourceManagerEndpoint+path, nil)
+		if e, ok := err.(*armError); ok && e.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return newError(provisioningFailure, err, "Failed to delete Cloud Shell settings")
+		}
+	}
+
+	fmt.Printf("Deleted the Cloud Shell settings. Run '%s setup' to set up Cloud Shell again.\n", os.Args[0])
+	return nil
+}
+
+// settingsTenant signs in and returns the tenant whose settings are managed
+func settingsTenant(tenantID, authMethods string) (string, error) {
+	authFlags.tenantID = tenantID
+	if err := configureCredentials(authMethods); err != nil {
+		return "", newError(usageFailure, err, "Invalid options")
+	}
+
+	if err := selectAccount(); err != nil {
+		return "", accountError(err)
+	}
+
+	return selectTenant(tenantID)
+}
+
+func validateSettingsOutput(output string) error {
+	if output != "table" && output != "json" {
+		return newError(usageFailure, nil, "Unknown output format '%s', use table or json", output)
+	}
+
+	return nil
+}
+
+// readRawUserSettings reads the user settings for a read-modify-write. Settings
+// that do not exist yet start out empty.
+func readRawUserSettings(tenantID string) (*rawUserSettings, error) {
+	s := &rawUserSettings{}
+
+	buf, err := sendRequest(tenantID, "GET", activeCloud.ResourceManagerEndpoint+userSettingsPath, nil)
+	if e, ok := err.(*armError); ok && e.StatusCode == http.StatusNotFound {
+		buf, err = nil, nil
+	}
+	if err != nil {
+		return nil, newError(provisioningFailure, err, "Request failed. Failed to read user settings")
+	}
+
+	if buf != nil {
+		if err := json.Unmarshal(buf, s); err != nil {
+			return nil, newError(provisioningFailure, err, "Failed to parse user settings")
+		}
+	}
+
+	if s.Properties == nil {
+		s.Properties = map[string]interface{}{"preferredOsType": "Linux"}
+	}
+
+	return s, nil
+}
+
+func printUserSettings(css *CloudShellSettings, output string) error {
+	if output == "json" {
+		return printJSON(css)
+	}
+
+	p := css.Properties
+	if p == nil {
+		p = &CloudShellSettingProperties{}
+	}
+
+	profile := p.StorageProfile
+	if profile == nil {
+		profile = &StorageProfile{}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Shell:\t%s\n", p.PreferredShellType)
+	fmt.Fprintf(w, "Location:\t%s\n", p.PreferredLocation)
+	fmt.Fprintf(w, "Storage account:\t%s\n", profile.StorageAccountResourceID)
+	fmt.Fprintf(w, "File share:\t%s\n", profile.FileShareName)
+	fmt.Fprintf(w, "Disk size (GB):\t%d\n", profile.DiskSizeInGB)
+	return w.Flush()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// command is a subcommand of azshell, for example 'azshell login'
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "login", description: "Sign in and cache the token without connecting.", run: runLogin},
+		{name: "auth", description: "List (auth list) or remove (auth logout) cached tokens.", run: runAuth},
+		{name: "token", description: "Print an access token for other tools (az account get-access-token format).", run: runToken},
+		{name: "settings", description: "Show (settings show), change (settings set) or delete (settings delete) the Cloud Shell settings.", run: runSettings},
+		{name: "setup", description: "Set up Cloud Shell storage and settings for first-time use.", run: runSetup},
+		{name: "whoami", description: "Show the identity and tenant azshell signs in with.", run: runWhoami},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [command] [options]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-10s %s\n", c.name, c.description)
+	}
+
+	fmt.Fprintf(flag.CommandLine.Output(), "\nRun without a command to connect to Cloud Shell. Options:\n")
+	flag.PrintDefaults()
+}
+
+func runLogin(args []string) error {
+	var authMethods string
+	var fromAzCli bool
+
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	fs.BoolVar(&fromAzCli, "from-az-cli", false, "Import the refresh token of an Azure CLI login instead of signing in. --account selects the Azure CLI account.")
+	addAuthFlags(fs, &authMethods)
+	fs.Parse(args)
+
+	if err := configureCredentials(authMethods); err != nil {
+		return newError(usageFailure, err, "Invalid options")
+	}
+
+	if fromAzCli {
+		if err := importAzCliLogin(authFlags.account); err != nil {
+			return newError(authFailure, err, "Failed to import the Azure CLI login")
+		}
+
+		return nil
+	}
+
+	if err := selectAccount(); err != nil {
+		return accountError(err)
+	}
+
+	if _, err := acquireBootstrapToken(); err != nil {
+		return newError(authFailure, err, "Login failed")
+	}
+
+	fmt.Println("Login succeeded.")
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/shlex"
+)
+
+// credentialProcessOutput is the JSON document the external command prints to stdout
+type credentialProcessOutput struct {
+	AccessToken string          `json:"accessToken"`
+	TokenType   string          `json:"tokenType"`
+	ExpiresOn   json.RawMessage `json:"expiresOn"`
+}
+
+type processToken struct {
+	header    string
+	expiresOn time.Time
+}
+
+// credentialProcessTokenProvider runs an external command configured with
+// credentialProcess to obtain tokens, and keeps them until they expire.
+type credentialProcessTokenProvider struct {
+	mu     sync.Mutex
+	tokens map[string]processToken
+}
+
+func (p *credentialProcessTokenProvider) Name() string {
+	return "process"
+}
+
+func (p *credentialProcessTokenProvider) Token(tenantID, resource string) (string, error) {
+	if authFlags.credentialProcess == "" {
+		return "", credentialUnavailable("credentialProcess is not configured")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := strings.ToLower(tenantID + "/" + resource)
+	if t, ok := p.tokens[key]; ok && time.Now().Add(tokenRefreshWindow).Before(t.expiresOn) {
+		return t.header, nil
+	}
+
+	t, err := runCredentialProcess(authFlags.credentialProcess, tenantID, resource)
+	if err != nil {
+		return "", err
+	}
+
+	if p.tokens == nil {
+		p.tokens = map[string]processToken{}
+	}
+	p.tokens[key] = *t
+
+	return t.header, nil
+}
+
+func runCredentialProcess(command, tenantID, resource string) (*processToken, error) {
+	args, err := shlex.Split(command)
+	if err != nil || len(args) == 0 {
+		return nil, fmt.Errorf("invalid credentialProcess '%s': %v", command, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "AZSHELL_TENANT_ID="+tenantID, "AZSHELL_RESOURCE="+resource)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential process failed: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out credentialProcessOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("failed to parse credential process output: %v", err)
+	}
+
+	if out.AccessToken == "" {
+		return nil, fmt.Errorf("credential process returned no accessToken")
+	}
+
+	expiresOn, err := parseExpiresOn(out.ExpiresOn)
+	if err != nil {
+		return nil, fmt.Errorf("credential process returned an invalid expiresOn: %v", err)
+	}
+
+	return &processToken{
+		header:    fmt.Sprintf("%s %s", firstNonEmpty(out.TokenType, "Bearer"), out.AccessToken),
+		expiresOn: expiresOn,
+	}, nil
+}
+
+// parseExpiresOn accepts unix seconds, RFC 3339, or the local time format
+// printed by 'az account get-access-token'.
+func parseExpiresOn(raw json.RawMessage) (time.Time, error) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		value = string(raw)
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation("2006-01-02 15:04:05.999999", value, time.Local)
+}
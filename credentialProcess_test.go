@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var parseExpiresOnTests = []struct {
+	raw     string
+	want    time.Time
+	wantErr bool
+}{
+	{raw: `1700000000`, want: time.Unix(1700000000, 0)},
+	{raw: `"1700000000"`, want: time.Unix(1700000000, 0)},
+	{raw: `"2023-11-14T22:13:20Z"`, want: time.Unix(1700000000, 0)},
+	{raw: `"2023-11-14T23:13:20+01:00"`, want: time.Unix(1700000000, 0)},
+	{raw: `"2023-11-14 22:13:20.000000"`, want: time.Date(2023, 11, 14, 22, 13, 20, 0, time.Local)},
+	{raw: `"2023-11-14 22:13:20"`, want: time.Date(2023, 11, 14, 22, 13, 20, 0, time.Local)},
+	{raw: `"next tuesday"`, wantErr: true},
+	{raw: `null`, wantErr: true},
+}
+
+func TestParseExpiresOn(t *testing.T) {
+	for _, test := range parseExpiresOnTests {
+		got, err := parseExpiresOn(json.RawMessage(test.raw))
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseExpiresOn(%s) error %v, want error %v", test.raw, err, test.wantErr)
+			continue
+		}
+
+		if !test.wantErr && !got.Equal(test.want) {
+			t.Errorf("parseExpiresOn(%s) = %v, want %v", test.raw, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/docker/docker/pkg/term"
+)
+
+const defaultDeviceCodeTimeout = 15 * time.Minute
+
+var (
+	errDeviceCodePending  = errors.New("authorization pending")
+	errDeviceCodeSlowDown = errors.New("slow down")
+)
+
+// deviceCodePrompt is what the user needs to finish a device code login.
+// With --device-code-output json it is written to stderr for wrappers.
+type deviceCodePrompt struct {
+	UserCode        string `json:"userCode"`
+	VerificationURI string `json:"verificationUri"`
+	Message         string `json:"message"`
+	ExpiresIn       int64  `json:"expiresIn"`
+}
+
+func validateDeviceCodeOutput(output string) error {
+	switch output {
+	case "", "text", "json":
+		return nil
+	default:
+		return fmt.Errorf("unknown device code output '%s', use text or json", output)
+	}
+}
+
+// showDeviceCode prints the login instructions, with a QR code of the
+// verification URL when stdout is a terminal.
+func showDeviceCode(prompt deviceCodePrompt) {
+	if authFlags.deviceCodeOutput == "json" {
+		buf, _ := json.Marshal(prompt)
+		fmt.Fprintln(os.Stderr, string(buf))
+		return
+	}
+
+	fmt.Println(prompt.Message)
+
+	if !term.IsTerminal(os.Stdout.Fd()) || prompt.VerificationURI == "" {
+		return
+	}
+
+	if q, err := encodeQRCode(prompt.VerificationURI); err == nil {
+		fmt.Printf("\nOr scan to open %s and enter the code %s:\n", prompt.VerificationURI, prompt.UserCode)
+		fmt.Print(q.render())
+	}
+}
+
+// waitForDeviceCode polls until the user finished the login, the code
+// expires, the --device-code-timeout passes or Ctrl-C is pressed.
+func waitForDeviceCode(interval, expiresIn time.Duration, poll func() (*adal.Token, error)) (*adal.Token, error) {
+	timeout := authFlags.deviceCodeTimeout
+	if timeout <= 0 {
+		timeout = defaultDeviceCodeTimeout
+	}
+	if expiresIn > 0 && expiresIn < timeout {
+		timeout = expiresIn
+	}
+
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-interrupt:
+			return nil, errors.New("login cancelled")
+		case <-deadline:
+			return nil, fmt.Errorf("timed out after %v waiting for the login to finish", timeout)
+		case <-time.After(interval):
+		}
+
+		token, err := poll()
+		switch err {
+		case nil:
+			return token, nil
+		case errDeviceCodePending:
+		case errDeviceCodeSlowDown:
+			interval += 5 * time.Second
+		default:
+			return nil, err
+		}
+	}
+}
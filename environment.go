@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const metadataEndpointsPath = "/metadata/endpoints?api-version=2015-01-01"
+
+// cloudEnvironment is the set of endpoints of an Azure cloud
+type cloudEnvironment struct {
+	Name                    string
+	ActiveDirectoryEndpoint string
+	ResourceManagerEndpoint string
+	ResourceManagerAudience string
+	GraphAudience           string // Microsoft Graph, used by az ad
+	KeyVaultAudience        string
+}
+
+// metadataEndpoints is the document served by ARM at /metadata/endpoints
+type metadataEndpoints struct {
+	MicrosoftGraphResourceID string `json:"microsoftGraphResourceId"`
+	Authentication           struct {
+		LoginEndpoint string   `json:"loginEndpoint"`
+		Audiences     []string `json:"audiences"`
+	} `json:"authentication"`
+}
+
+var (
+	azurePublicCloud = cloudEnvironment{
+		Name:                    "AzureCloud",
+		ActiveDirectoryEndpoint: "https://login.microsoftonline.com/",
+		ResourceManagerEndpoint: "https://management.azure.com",
+		ResourceManagerAudience: "https://management.core.windows.net/",
+		GraphAudience:           "https://graph.microsoft.com/",
+		KeyVaultAudience:        "https://vault.azure.net",
+	}
+
+	azureChinaCloud = cloudEnvironment{
+		Name:                    "AzureChinaCloud",
+		ActiveDirectoryEndpoint: "https://login.chinacloudapi.cn/",
+		ResourceManagerEndpoint: "https://management.chinacloudapi.cn",
+		ResourceManagerAudience: "https://management.core.chinacloudapi.cn/",
+		GraphAudience:           "https://microsoftgraph.chinacloudapi.cn/",
+		KeyVaultAudience:        "https://vault.azure.cn",
+	}
+
+	azureUSGovernmentCloud = cloudEnvironment{
+		Name:                    "AzureUSGovernment",
+		ActiveDirectoryEndpoint: "https://login.microsoftonline.us/",
+		ResourceManagerEndpoint: "https://management.usgovcloudapi.net",
+		ResourceManagerAudience: "https://management.core.usgovcloudapi.net/",
+		GraphAudience:           "https://graph.microsoft.us/",
+		KeyVaultAudience:        "https://vault.usgovcloudapi.net",
+	}
+
+	clouds = map[string]cloudEnvironment{
+		strings.ToLower(azurePublicCloud.Name):       azurePublicCloud,
+		strings.ToLower(azureChinaCloud.Name):        azureChinaCloud,
+		strings.ToLower(azureUSGovernmentCloud.Name): azureUSGovernmentCloud,
+	}
+
+	activeCloud = azurePublicCloud
+)
+
+func cloudNames() []string {
+	names := []string{}
+	for _, c := range clouds {
+		names = append(names, c.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (c cloudEnvironment) resourceManagerHost() string {
+	u, err := url.Parse(c.ResourceManagerEndpoint)
+	if err != nil {
+		return c.ResourceManagerEndpoint
+	}
+
+	return u.Hostname()
+}
+
+// selectCloud makes the named cloud active. A https URL is taken as the
+// Resource Manager endpoint of a custom cloud such as Azure Stack, and its
+// endpoints are discovered from the metadata document.
+func selectCloud(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	if c, ok := clouds[strings.ToLower(name)]; ok {
+		activeCloud = c
+		return nil
+	}
+
+	if !strings.HasPrefix(strings.ToLower(name), "https://") {
+		return fmt.Errorf("unknown cloud '%s', use one of %s or the https URL of a Resource Manager endpoint", name, strings.Join(cloudNames(), ", "))
+	}
+
+	c, err := discoverCloud(name)
+	if err != nil {
+		return err
+	}
+
+	activeCloud = *c
+	return nil
+}
+
+func discoverCloud(resourceManagerEndpoint string) (*cloudEnvironment, error) {
+	resourceManagerEndpoint = strings.TrimSuffix(resourceManagerEndpoint, "/")
+
+	req, _ := http.NewRequest(http.MethodGet, resourceManagerEndpoint+metadataEndpointsPath, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	client := &http.Client{}
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to discover cloud endpoints: %v", err)
+	}
+
+	defer response.Body.Close()
+	buf, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to discover cloud endpoints: %v", err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to discover cloud endpoints: %s", response.Status)
+	}
+
+	var metadata metadataEndpoints
+	if err := json.Unmarshal(buf, &metadata); err != nil {
+		return nil, fmt.Errorf("Failed to parse cloud endpoints: %v", err)
+	}
+
+	if metadata.Authentication.LoginEndpoint == "" || len(metadata.Authentication.Audiences) == 0 {
+		return nil, fmt.Errorf("Cloud endpoints of %s have no authentication settings", resourceManagerEndpoint)
+	}
+
+	c := &cloudEnvironment{
+		ActiveDirectoryEndpoint: strings.TrimSuffix(metadata.Authentication.LoginEndpoint, "/") + "/",
+		ResourceManagerEndpoint: resourceManagerEndpoint,
+		ResourceManagerAudience: metadata.Authentication.Audiences[0],
+		// graphEndpoint is the retired Azure AD Graph, a cloud without
+		// Microsoft Graph gets no Graph token
+		GraphAudience: metadata.MicrosoftGraphResourceID,
+	}
+	c.Name = c.resourceManagerHost()
+
+	return c, nil
+}
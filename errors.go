@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Exit codes of azshell, documented in the README
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitUsage        = 2
+	exitAuth         = 3
+	exitTenant       = 4
+	exitNotSetUp     = 5
+	exitProvisioning = 6
+	exitTerminal     = 7
+	exitWebsocket    = 8
+	exitNetwork      = 9
+)
+
+// errorKind tells which step of connecting to Cloud Shell failed
+type errorKind int
+
+const (
+	authFailure errorKind = iota
+	tenantFailure
+	notSetUpFailure
+	provisioningFailure
+	terminalFailure
+	websocketFailure
+	usageFailure
+)
+
+var exitCodes = map[errorKind]int{
+	authFailure:         exitAuth,
+	tenantFailure:       exitTenant,
+	notSetUpFailure:     exitNotSetUp,
+	provisioningFailure: exitProvisioning,
+	terminalFailure:     exitTerminal,
+	websocketFailure:    exitWebsocket,
+	usageFailure:        exitUsage,
+}
+
+// azshellError is a failure of one step, with the error that caused it
+type azshellError struct {
+	Kind    errorKind
+	Message string
+	Err     error
+}
+
+// newError describes the failure of a step. An err that is an azshellError
+// already is returned as is, the step that failed first decides the exit code.
+func newError(kind errorKind, err error, format string, args ...interface{}) error {
+	var e *azshellError
+	if errors.As(err, &e) {
+		return err
+	}
+
+	return &azshellError{Kind: kind, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+func (e *azshellError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *azshellError) Unwrap() error {
+	return e.Err
+}
+
+// armError is an error response of Resource Manager or the console service
+type armError struct {
+	StatusCode int
+	Status     string
+	Code       string
+	Message    string
+}
+
+func (e *armError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s %s", e.Status, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s %s", e.Status, e.Code, e.Message)
+}
+
+// responseError reads the ARM error code and message from a failed response
+func responseError(response *http.Response, buf []byte) error {
+	e := &armError{StatusCode: response.StatusCode, Status: response.Status}
+
+	body := struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+
+	if json.Unmarshal(buf, &body) == nil && body.Error.Message != "" {
+		e.Code = body.Error.Code
+		e.Message = body.Error.Message
+	} else {
+		e.Message = strings.TrimSpace(string(buf))
+	}
+
+	return e
+}
+
+// exitCode maps an error to the exit code of the process. Network failures
+// take precedence over the step they happened in.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var urlErr *url.Error
+	var netErr net.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) {
+		return exitNetwork
+	}
+
+	var e *azshellError
+	if errors.As(err, &e) {
+		if code, ok := exitCodes[e.Kind]; ok {
+			return code
+		}
+	}
+
+	return exitFailure
+}
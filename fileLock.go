@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	fileLockTimeout      = 30 * time.Second
+	fileLockPollInterval = 100 * time.Millisecond
+)
+
+// lockFile takes an advisory lock on <path>.lock shared by all azshell
+// processes, waiting up to fileLockTimeout for another process to release it.
+// The returned function releases the lock.
+func lockFile(path string) (func(), error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s.lock: %v", path, err)
+	}
+
+	deadline := time.Now().Add(fileLockTimeout)
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+		}
+
+		if locked {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out waiting for another azshell process to release %s", path)
+		}
+
+		time.Sleep(fileLockPollInterval)
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
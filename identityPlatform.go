@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+const (
+	loginEndpointV1 = "v1"
+	loginEndpointV2 = "v2"
+
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// clientCapabilities declares that azshell handles claims challenges, which
+	// opts its tokens in to continuous access evaluation.
+	clientCapabilities = `{"access_token":{"xms_cc":{"values":["CP1"]}}}`
+)
+
+// loginEndpoint is the Azure AD endpoint version used for user sign-in.
+// Version 1 takes a resource, version 2 (the Microsoft identity platform) takes scopes.
+var loginEndpoint = loginEndpointV2
+
+type tokenErrorResponse struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+type v2DeviceCode struct {
+	DeviceCode      string      `json:"device_code"`
+	UserCode        string      `json:"user_code"`
+	VerificationURI string      `json:"verification_uri"`
+	Message         string      `json:"message"`
+	ExpiresIn       json.Number `json:"expires_in"`
+	Interval        json.Number `json:"interval"`
+}
+
+func selectLoginEndpoint(version string) error {
+	switch strings.ToLower(version) {
+	case "":
+		return nil
+	case loginEndpointV1, loginEndpointV2:
+		loginEndpoint = strings.ToLower(version)
+		return nil
+	default:
+		return fmt.Errorf("unknown login endpoint '%s', use %s or %s", version, loginEndpointV1, loginEndpointV2)
+	}
+}
+
+// resourceScopes maps a v1 resource to v2 scopes. The resource is kept as is,
+// so "https://management.core.windows.net/" becomes ".../.default" with a
+// double slash, which is what Resource Manager expects.
+func resourceScopes(resource string) string {
+	return resource + "/.default offline_access"
+}
+
+// oauthEndpoint returns the URL of an OAuth endpoint (authorize, token or
+// devicecode) of the tenant for the active login endpoint version.
+func oauthEndpoint(tenantID, name string) string {
+	if loginEndpoint == loginEndpointV2 {
+		return fmt.Sprintf("%s%s/oauth2/v2.0/%s", activeCloud.ActiveDirectoryEndpoint, tenantID, name)
+	}
+
+	return fmt.Sprintf("%s%s/oauth2/%s", activeCloud.ActiveDirectoryEndpoint, tenantID, name)
+}
+
+// setResource adds the requested resource to a token request, as a resource
+// for v1 or as scopes for v2, along with the claims to request.
+func setResource(form url.Values, resource, challenge string) {
+	if loginEndpoint == loginEndpointV2 {
+		form.Set("scope", resourceScopes(resource))
+	} else {
+		form.Set("resource", resource)
+	}
+
+	if claims := requestClaims(challenge); claims != "" {
+		form.Set("claims", claims)
+	}
+}
+
+// requestClaims returns the claims parameter of a token request: the claims
+// of a challenge merged with the client capabilities on v2.
+func requestClaims(challenge string) string {
+	if loginEndpoint != loginEndpointV2 {
+		return challenge
+	}
+
+	if challenge == "" {
+		return clientCapabilities
+	}
+
+	claims := map[string]map[string]interface{}{}
+	if err := json.Unmarshal([]byte(challenge), &claims); err != nil {
+		return challenge
+	}
+
+	capabilities := map[string]map[string]interface{}{}
+	json.Unmarshal([]byte(clientCapabilities), &capabilities)
+	for name, value := range capabilities["access_token"] {
+		if claims["access_token"] == nil {
+			claims["access_token"] = map[string]interface{}{}
+		}
+		claims["access_token"][name] = value
+	}
+
+	buf, err := json.Marshal(claims)
+	if err != nil {
+		return challenge
+	}
+
+	return string(buf)
+}
+
+// parseTokenResponse reads the token from a v1 or v2 token response. v2 does
+// not return expires_on, it is computed from expires_in.
+func parseTokenResponse(buf []byte, resource string) (*adal.Token, error) {
+	var token adal.Token
+	if err := json.Unmarshal(buf, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %v", err)
+	}
+
+	if token.ExpiresOn == "" && token.ExpiresIn != "" {
+		seconds, err := token.ExpiresIn.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires_in in token response: %v", err)
+		}
+
+		token.ExpiresOn = json.Number(strconv.FormatInt(time.Now().Add(time.Duration(seconds)*time.Second).Unix(), 10))
+	}
+
+	if token.Resource == "" {
+		token.Resource = resource
+	}
+
+	return &token, nil
+}
+
+// postTokenRequest sends a form to the token endpoint of the tenant. Error
+// responses of Azure AD are returned as *tokenErrorResponse.
+func postTokenRequest(tenantID string, form url.Values, resource string) (*adal.Token, error) {
+	form.Set("client_id", clientAppID)
+
+	req, err := http.NewRequest(http.MethodPost, oauthEndpoint(tenantID, "token"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := &tokenErrorResponse{}
+		if json.Unmarshal(buf, e) == nil && e.Code != "" {
+			return nil, e
+		}
+
+		return nil, fmt.Errorf("token request failed: %s %s", resp.Status, string(buf))
+	}
+
+	return parseTokenResponse(buf, resource)
+}
+
+func (e *tokenErrorResponse) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// redeemRefreshToken exchanges a refresh token for a token of the resource.
+// The response carries a new refresh token, callers cache it so the refresh
+// token is rotated on every use.
+func redeemRefreshToken(tenantID, resource, refreshToken string) (*adal.Token, error) {
+	if loginEndpoint == loginEndpointV1 {
+		oauthConfig, err := adal.NewOAuthConfig(activeCloud.ActiveDirectoryEndpoint, tenantID)
+		if err != nil {
+			return nil, err
+		}
+
+		spt, err := adal.NewServicePrincipalTokenFromManualToken(*oauthConfig, clientAppID, resource, adal.Token{RefreshToken: refreshToken})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := spt.Refresh(); err != nil {
+			return nil, err
+		}
+
+		token := spt.Token()
+		return &token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	setResource(form, resource, "")
+
+	token, err := postTokenRequest(tenantID, form, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	// Azure AD may not rotate the refresh token, keep the current one then.
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+
+	return token, nil
+}
+
+// deviceCodeLogin signs the user in with the device code flow. The challenge
+// carries the claims of a conditional access claims challenge, if any.
+func deviceCodeLogin(tenantID, resource, challenge string) (*adal.Token, error) {
+	if loginEndpoint == loginEndpointV1 {
+		if challenge != "" {
+			return nil, fmt.Errorf("claims challenges need the v2 login endpoint")
+		}
+
+		oauthConfig, err := adal.NewOAuthConfig(activeCloud.ActiveDirectoryEndpoint, tenantID)
+		if err != nil {
+			return nil, err
+		}
+
+		spt, err := acquireTokenDeviceCodeFlow(*oauthConfig, clientAppID, resource)
+		if err != nil {
+			return nil, err
+		}
+
+		token := spt.Token()
+		return &token, nil
+	}
+
+	return acquireTokenDeviceCodeFlowV2(tenantID, resource, challenge)
+}
+
+func acquireTokenDeviceCodeFlowV2(tenantID, resource, challenge string) (*adal.Token, error) {
+	form := url.Values{}
+	form.Set("client_id", clientAppID)
+	setResource(form, resource, challenge)
+
+	client := &http.Client{}
+	resp, err := client.PostForm(oauthEndpoint(tenantID, "devicecode"), form)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start device auth flow: %s", err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start device auth flow: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to start device auth flow: %s %s", resp.Status, string(buf))
+	}
+
+	var code v2DeviceCode
+	if err := json.Unmarshal(buf, &code); err != nil {
+		return nil, fmt.Errorf("Failed to start device auth flow: %s", err)
+	}
+
+	interval, _ := code.Interval.Int64()
+	expiresIn, _ := code.ExpiresIn.Int64()
+	showDeviceCode(deviceCodePrompt{code.UserCode, code.VerificationURI, code.Message, expiresIn})
+
+	token, err := waitForDeviceCode(time.Duration(interval)*time.Second, time.Duration(expiresIn)*time.Second, func() (*adal.Token, error) {
+		form := url.Values{}
+		form.Set("grant_type", deviceCodeGrantType)
+		form.Set("device_code", code.DeviceCode)
+		setResource(form, resource, challenge)
+
+		token, err := postTokenRequest(tenantID, form, resource)
+		if e, ok := err.(*tokenErrorResponse); ok {
+			switch e.Code {
+			case "authorization_pending":
+				return nil, errDeviceCodePending
+			case "slow_down":
+				return nil, errDeviceCodeSlowDown
+			}
+		}
+		return token, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to finish device auth flow: %s", err)
+	}
+
+	return token, nil
+}
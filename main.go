@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -16,90 +15,93 @@ import (
 )
 
 func main() {
-	var tenantID, shellType string
+	if len(os.Args) > 1 {
+		if cmd := findCommand(os.Args[1]); cmd != nil {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				exitWithError(err)
+			}
+			return
+		}
+	}
+
+	var tenantID, shellType, location, authMethods string
 	var reset, help bool
+	var provisionTimeout time.Duration
 	flag.StringVar(&tenantID, "tenant", "", "Specify the tenant Id.")
-	flag.BoolVar(&reset, "reset", false, "Reset the presisted tenant settings.")
+	flag.BoolVar(&reset, "reset", false, "Reset the presisted tenant settings and cached tokens.")
 	flag.BoolVar(&help, "help", false, "Show the help text.")
 	flag.StringVar(&shellType, "shell", "", "Force to request the specified shell (bash|pwsh).")
+	flag.StringVar(&location, "location", "", "Cloud Shell region, a comma separated list of regions to fail over to in order, or auto for the lowest latency (default the preferred location in the Cloud Shell settings).")
+	flag.DurationVar(&provisionTimeout, "provision-timeout", defaultProvisionTimeout, "How long to wait for Cloud Shell to be provisioned.")
+	addAuthFlags(flag.CommandLine, &authMethods)
+	flag.Usage = usage
 	flag.Parse()
 
+	authFlags.tenantID = tenantID
+
 	if help {
 		flag.Usage()
 		return
 	}
 
 	if reset {
-		err := os.Remove(defaultSettingsPath())
-		if err != nil {
+		failed := false
+		if err := os.Remove(defaultSettingsPath()); err != nil && !os.IsNotExist(err) {
 			log.Printf("Failed to remove settings: %v", err)
+			failed = true
 		}
-		return
-	}
 
-	token, err := acquireBootstrapToken()
-	if err != nil {
-		fmt.Println(err)
+		if _, err := removeCachedTokens("", ""); err != nil {
+			log.Printf("Failed to remove cached tokens: %v", err)
+			failed = true
+		}
+
+		if failed {
+			os.Exit(exitFailure)
+		}
 		return
 	}
 
-	tenants, err := getTenants(token)
+	locations, err := parseLocations(location)
 	if err != nil {
-		fmt.Println(errors.New("Failed to list tenants: " + err.Error()))
-		return
+		exitWithError(newError(usageFailure, err, "Invalid options"))
 	}
 
-	if len(tenants) == 0 {
-		fmt.Println("No tenants found.")
-		return
+	if err := configureCredentials(authMethods); err != nil {
+		exitWithError(newError(usageFailure, err, "Invalid options"))
 	}
 
-	if len(tenants) == 1 && tenantID == "" {
-		tenantID = tenants[0].TenantID
+	if err := selectAccount(); err != nil {
+		exitWithError(accountError(err))
 	}
 
-	if len(tenants) > 1 && tenantID == "" {
-		s, err := readSettings()
-		if err != nil || s.ActiveTenant == "" {
-			options := []string{}
-
-			for _, t := range tenants {
-				options = append(options, fmt.Sprintf("%s (%s)", t.DisplayName, t.TenantID))
-			}
-
-			prompt := promptui.Select{
-				Label: "Select Tenant",
-				Items: options,
-			}
-
-			index, _, err := prompt.Run()
-			if err != nil {
-				fmt.Println("Specify the --tenant option since multiple tenant available.")
-				return
-			}
-
-			tenantID = tenants[index].TenantID
-			saveSettings(settings{ActiveTenant: tenantID})
-		} else {
-			tenantID = s.ActiveTenant
-		}
+	tenantID, err = selectTenant(tenantID)
+	if err != nil {
+		exitWithError(err)
 	}
 
 	css, err := ReadCloudShellUserSettings(tenantID)
 	if err != nil {
-		fmt.Println(err)
-		return
+		exitWithError(err)
 	}
 
 	if css.Properties == nil || css.Properties.StorageProfile == nil {
-		fmt.Println("It seems you haven't setup your cloud shell account yet. Navigate to https://shell.azure.com to complete account setup.")
-		return
+		exitWithError(newError(notSetUpFailure, nil, "It seems you haven't setup your cloud shell account yet. Run '%s setup' or navigate to https://shell.azure.com to complete account setup.", os.Args[0]))
 	}
 
-	uri, err := RequestCloudShell(tenantID)
+	if isAutoLocation(locations) {
+		if locations, err = autoLocations(); err != nil {
+			exitWithError(newError(usageFailure, err, "Failed to select the Cloud Shell region"))
+		}
+	}
+
+	if len(locations) == 0 && css.Properties.PreferredLocation != "" {
+		locations = []string{css.Properties.PreferredLocation}
+	}
+
+	uri, err := RequestCloudShellIn(tenantID, locations, provisionTimeout)
 	if err != nil {
-		fmt.Println(err)
-		return
+		exitWithError(err)
 	}
 
 	if shellType != "pwsh" && shellType != "bash" {
@@ -107,21 +109,36 @@ func main() {
 	}
 
 	t, err := RequestTerminal(tenantID, uri, shellType)
-	if err != nil || t.SocketURI == "" {
-		fmt.Println("Failed to connect to cloud shell terminal.", err)
-		return
+	if err != nil {
+		exitWithError(err)
+	}
+
+	// From here on the terminal is in raw mode, tokens must be renewed without prompts.
+	session, err := newTokenManager(tenantID, credentials)
+	if err != nil {
+		exitWithError(newError(authFailure, err, "Failed to start token renewal"))
+	}
+
+	credentials = session
+	go session.run()
+
+	tokens, err := openTokenChannel(tenantID, uri)
+	if err != nil {
+		log.Printf("Tokens of Cloud Shell will not be renewed: %v", err)
+	} else {
+		go tokens.serve()
 	}
 
 	wsConfig := ws.Config{
 		ConnectRetryWaitDuration: time.Second * 1,
+		ConnectRetries:           10,
 		SendReceiveBufferSize:    8192,
 		URL: t.SocketURI,
 	}
 
 	wsChan, err := ws.NewWebsocketChannel(wsConfig)
 	if err != nil {
-		log.Fatal(err)
-		return
+		exitWithError(newError(websocketFailure, err, "Failed to connect to the terminal websocket"))
 	}
 
 	stdIn, stdOut, _ := term.StdStreams()
@@ -139,6 +156,62 @@ func main() {
 	receive(wsChan, stdOut)
 }
 
+// selectTenant returns the tenant to connect to: the given one, the only
+// tenant of the user, the persisted one, or the one picked in a prompt.
+func selectTenant(tenantID string) (string, error) {
+	token, err := acquireBootstrapToken()
+	if err != nil {
+		return "", newError(authFailure, err, "Failed to sign in")
+	}
+
+	tenants, err := getTenants(token)
+	if err != nil {
+		return "", err
+	}
+
+	if len(tenants) == 0 {
+		return "", newError(tenantFailure, nil, "No tenants found.")
+	}
+
+	if len(tenants) == 1 && tenantID == "" {
+		tenantID = tenants[0].TenantID
+	}
+
+	if len(tenants) > 1 && tenantID == "" {
+		s, err := readSettings()
+		if err != nil || s.ActiveTenant == "" {
+			options := []string{}
+
+			for _, t := range tenants {
+				options = append(options, fmt.Sprintf("%s (%s)", t.DisplayName, t.TenantID))
+			}
+
+			prompt := promptui.Select{
+				Label: "Select Tenant",
+				Items: options,
+			}
+
+			index, _, err := prompt.Run()
+			if err != nil {
+				return "", newError(tenantFailure, nil, "Specify the --tenant option since multiple tenant available.")
+			}
+
+			tenantID = tenants[index].TenantID
+			updateSettings(func(s *settings) { s.ActiveTenant = tenantID })
+		} else {
+			tenantID = s.ActiveTenant
+		}
+	}
+
+	return tenantID, nil
+}
+
+// exitWithError prints the error and exits with the code of its kind
+func exitWithError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(exitCode(err))
+}
+
 func monitorSize(t *Terminal) {
 	curSize := &term.Winsize{}
 	for {
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	msiEndpointEnvVar      = "MSI_ENDPOINT"
+	msiSecretEnvVar        = "MSI_SECRET"
+	identityEndpointEnvVar = "IDENTITY_ENDPOINT"
+	identityHeaderEnvVar   = "IDENTITY_HEADER"
+	imdsEndpointEnvVar     = "IMDS_ENDPOINT"
+
+	imdsHost             = "169.254.169.254:80"
+	imdsTokenEndpoint    = "http://169.254.169.254/metadata/identity/oauth2/token"
+	imdsAPIVersion       = "2018-02-01"
+	appServiceAPIVersion = "2019-08-01"
+	arcAPIVersion        = "2020-06-01"
+	imdsProbeTimeout     = time.Second
+
+	// The Azure Arc agent only writes its challenge keys here, see the Azure SDKs
+	arcKeyDirLinux  = "/var/opt/azcmagent/tokens"
+	arcKeyExtension = ".key"
+	arcKeyMaxSize   = 4096
+
+	// managedIdentityTimeout bounds a token request, a host that drops the
+	// packets must not hang azshell
+	managedIdentityTimeout = 10 * time.Second
+)
+
+type responseJSON struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Resource     string `json:"resource"`
+	TokenType    string `json:"token_type"`
+}
+
+type managedIdentityError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// managedIdentityResponseError is an error response of a managed identity endpoint
+type managedIdentityResponseError struct {
+	StatusCode  int
+	Status      string
+	Code        string
+	Description string
+	Body        string
+}
+
+func (e *managedIdentityResponseError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("Managed identity endpoint returned %s: %s", e.Status, e.Body)
+	}
+
+	return fmt.Sprintf("Managed identity endpoint returned %s: %s %s", e.Status, e.Code, e.Description)
+}
+
+// msiTokenProvider uses the managed identity of the host. It supports the
+// App Service/Functions (IDENTITY_ENDPOINT and IDENTITY_HEADER), Azure Arc
+// (IDENTITY_ENDPOINT and IMDS_ENDPOINT) and legacy MSI_ENDPOINT protocols,
+// and the Azure VM instance metadata service. The instance metadata service
+// has no environment variable announcing it, so it is only used when msi is
+// selected with --auth or a user-assigned identity is given.
+type msiTokenProvider struct {
+	useIMDS bool
+
+	probeOnce     sync.Once
+	imdsReachable bool
+}
+
+func (p *msiTokenProvider) Name() string {
+	return "msi"
+}
+
+func (p *msiTokenProvider) Token(tenantID, resource string) (string, error) {
+	if endpoint := os.Getenv(identityEndpointEnvVar); endpoint != "" {
+		if header := os.Getenv(identityHeaderEnvVar); header != "" {
+			return acquireAuthTokenAppService(endpoint, header, resource)
+		}
+
+		if os.Getenv(imdsEndpointEnvVar) != "" {
+			return acquireAuthTokenArc(endpoint, resource)
+		}
+	}
+
+	if endpoint := os.Getenv(msiEndpointEnvVar); endpoint != "" {
+		return acquireAuthTokenMSI(endpoint, resource)
+	}
+
+	if !p.useIMDS && !authFlags.hasIdentitySelector() {
+		return "", credentialUnavailable("no managed identity endpoint found, use --auth msi for the instance metadata service")
+	}
+
+	p.probeOnce.Do(func() {
+		conn, err := net.DialTimeout("tcp", imdsHost, imdsProbeTimeout)
+		if err == nil {
+			conn.Close()
+			p.imdsReachable = true
+		}
+	})
+
+	if !p.imdsReachable {
+		return "", credentialUnavailable("no managed identity endpoint found")
+	}
+
+	token, err := acquireAuthTokenIMDS(resource)
+	if e, ok := err.(*managedIdentityResponseError); ok && (e.Code == "" || isIdentityNotFound(e)) {
+		// A VM without an identity, or something else listening on the address
+		return "", credentialUnavailable("instance metadata service: %v", err)
+	}
+
+	return token, err
+}
+
+func isIdentityNotFound(e *managedIdentityResponseError) bool {
+	return e.StatusCode == http.StatusBadRequest && strings.Contains(strings.ToLower(e.Description), "identity not found")
+}
+
+func (o authOptions) hasIdentitySelector() bool {
+	return o.identityClientID != "" || o.identityObjectID != "" || o.identityResourceID != ""
+}
+
+// identitySelector returns the query parameter selecting the user-assigned
+// identity. An empty parameter name means the protocol does not support that selector.
+func (o authOptions) identitySelector(clientIDParam, objectIDParam, resourceIDParam string) (url.Values, error) {
+	selectors := []struct {
+		value, param, flag string
+	}{
+		{o.identityClientID, clientIDParam, "--identity-client-id"},
+		{o.identityObjectID, objectIDParam, "--identity-object-id"},
+		{o.identityResourceID, resourceIDParam, "--identity-resource-id"},
+	}
+
+	parameters := url.Values{}
+	for _, s := range selectors {
+		if s.value == "" {
+			continue
+		}
+
+		if len(parameters) > 0 {
+			return nil, fmt.Errorf("only one of --identity-client-id, --identity-object-id and --identity-resource-id can be specified")
+		}
+
+		if s.param == "" {
+			return nil, fmt.Errorf("%s is not supported by this managed identity endpoint", s.flag)
+		}
+
+		parameters.Add(s.param, s.value)
+	}
+
+	return parameters, nil
+}
+
+func acquireAuthTokenIMDS(resource string) (string, error) {
+	parameters, err := authFlags.identitySelector("client_id", "object_id", "msi_res_id")
+	if err != nil {
+		return "", err
+	}
+
+	parameters.Add("api-version", imdsAPIVersion)
+	parameters.Add("resource", resource)
+
+	req, err := http.NewRequest(http.MethodGet, imdsTokenEndpoint+"?"+parameters.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Add("Metadata", "true")
+	return requestManagedIdentityToken(req)
+}
+
+func acquireAuthTokenAppService(endpoint, header, resource string) (string, error) {
+	parameters, err := authFlags.identitySelector("client_id", "principal_id", "mi_res_id")
+	if err != nil {
+		return "", err
+	}
+
+	parameters.Add("api-version", appServiceAPIVersion)
+	parameters.Add("resource", resource)
+
+	req, err := newManagedIdentityRequest(endpoint, parameters)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Add("X-IDENTITY-HEADER", header)
+	return requestManagedIdentityToken(req)
+}
+
+// acquireAuthTokenArc implements the Azure Arc challenge: the first request is
+// rejected with the path of a key file that only local administrators can read.
+func acquireAuthTokenArc(endpoint, resource string) (string, error) {
+	parameters, err := authFlags.identitySelector("", "", "")
+	if err != nil {
+		return "", err
+	}
+
+	parameters.Add("api-version", arcAPIVersion)
+	parameters.Add("resource", resource)
+
+	req, err := newManagedIdentityRequest(endpoint, parameters)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Metadata", "true")
+
+	client := &http.Client{Timeout: managedIdentityTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to reach managed identity endpoint: %v", err)
+	}
+	resp.Body.Close()
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(challenge, "Basic realm=") {
+		return "", fmt.Errorf("Unexpected response from Azure Arc managed identity endpoint: %s", resp.Status)
+	}
+
+	path, err := arcKeyPath(strings.TrimPrefix(challenge, "Basic realm="))
+	if err != nil {
+		return "", err
+	}
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read Azure Arc managed identity key: %v", err)
+	}
+
+	req, err = newManagedIdentityRequest(endpoint, parameters)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Metadata", "true")
+	req.Header.Add("Authorization", "Basic "+string(key))
+
+	return requestManagedIdentityToken(req)
+}
+
+// arcKeyPath checks the key file named in the challenge of the Azure Arc
+// endpoint, a spoofed endpoint must not make azshell send any readable file
+func arcKeyPath(path string) (string, error) {
+	dir, equal := arcKeyDirLinux, func(a, b string) bool { return a == b }
+	switch runtime.GOOS {
+	case "linux":
+	case "windows":
+		dir, equal = filepath.Join(os.Getenv("ProgramData"), "AzureConnectedMachineAgent", "Tokens"), strings.EqualFold
+	default:
+		return "", fmt.Errorf("Azure Arc managed identity is not supported on %s", runtime.GOOS)
+	}
+
+	path = filepath.Clean(path)
+	if !equal(filepath.Dir(path), dir) || !equal(filepath.Ext(path), arcKeyExtension) {
+		return "", fmt.Errorf("Azure Arc managed identity key %s is not a %s file in %s", path, arcKeyExtension, dir)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read Azure Arc managed identity key: %v", err)
+	}
+
+	if info.Size() > arcKeyMaxSize {
+		return "", fmt.Errorf("Azure Arc managed identity key %s is larger than %d bytes", path, arcKeyMaxSize)
+	}
+
+	return path, nil
+}
+
+func acquireAuthTokenMSI(endpoint, resource string) (string, error) {
+	parameters, err := authFlags.identitySelector("clientid", "", "")
+	if err != nil {
+		return "", err
+	}
+
+	parameters.Add("resource", resource)
+
+	req, err := newManagedIdentityRequest(endpoint, parameters)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Add("Metadata", "true")
+	if secret := os.Getenv(msiSecretEnvVar); secret != "" {
+		req.Header.Add("Secret", secret)
+	}
+
+	return requestManagedIdentityToken(req)
+}
+
+func newManagedIdentityRequest(endpoint string, parameters url.Values) (*http.Request, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid managed identity endpoint '%s': %v", endpoint, err)
+	}
+
+	u.RawQuery = parameters.Encode()
+	return http.NewRequest(http.MethodGet, u.String(), nil)
+}
+
+func requestManagedIdentityToken(req *http.Request) (string, error) {
+	client := &http.Client{Timeout: managedIdentityTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to reach managed identity endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+
+	responseBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := &managedIdentityResponseError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(responseBytes)}
+
+		var body managedIdentityError
+		if json.Unmarshal(responseBytes, &body) == nil && body.Error != "" {
+			e.Code = body.Error
+			e.Description = body.ErrorDescription
+		}
+
+		return "", e
+	}
+
+	var r responseJSON
+	if err := json.Unmarshal(responseBytes, &r); err != nil {
+		return "", fmt.Errorf("Failed to parse managed identity token: %v", err)
+	}
+
+	if r.AccessToken == "" {
+		return "", fmt.Errorf("Managed identity endpoint returned no access token")
+	}
+
+	return r.TokenType + " " + r.AccessToken, nil
+}
@@ -8,15 +8,19 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/pkg/term"
 )
 
 var (
-	resourceURI = "https://management.azure.com/providers/Microsoft.Portal/consoles/default?api-version=2018-10-01"
-	settingsURI = "https://management.azure.com/providers/Microsoft.Portal/userSettings/cloudconsole?api-version=2018-10-01"
-	userAgent   = "github.com/yangl900/azshell"
+	consolePath      = "/providers/Microsoft.Portal/consoles/default?api-version=2018-10-01"
+	userSettingsPath = "/providers/Microsoft.Portal/userSettings/cloudconsole?api-version=2018-10-01"
+	userAgent        = "github.com/yangl900/azshell"
+
+	preferredLocationHeader = "x-ms-console-preferred-location"
 )
 
 type consoleRequest struct {
@@ -27,13 +31,30 @@ type consoleRequestProperties struct {
 	OsType string `json:"osType"`
 }
 
+// terminalRequest hands Cloud Shell the tokens of additional resources, so
+// tools in the session are signed in to them like in the browser portal
+type terminalRequest struct {
+	Tokens []string `json:"tokens"`
+}
+
 type consoleResponse struct {
 	Properties consoleResponseProperties `json:"properties"`
 }
 
 type consoleResponseProperties struct {
-	ProvisioningState string `json:"provisioningState"`
-	URI               string `json:"uri"`
+	ProvisioningState string     `json:"provisioningState"`
+	URI               string     `json:"uri"`
+	Error             *errorInfo `json:"error"`
+}
+
+// errorInfo is the error detail of a failed operation
+type errorInfo struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *errorInfo) Error() string {
+	return e.Code + " " + e.Message
 }
 
 // Terminal is the cloud shell terminal
@@ -51,7 +72,7 @@ type CloudShellSettings struct {
 
 // CloudShellSettingProperties is the properties of cloud shell setting
 type CloudShellSettingProperties struct {
-	PreferredLocation  string          `json:"preferredLoction"`
+	PreferredLocation  string          `json:"preferredLocation"`
 	StorageProfile     *StorageProfile `json:"storageProfile"`
 	PreferredShellType string          `json:"preferredShellType"`
 }
@@ -65,37 +86,26 @@ type StorageProfile struct {
 
 // ReadCloudShellUserSettings read the user settings of cloud shell
 func ReadCloudShellUserSettings(tenantID string) (*CloudShellSettings, error) {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", settingsURI, nil)
-
-	token, err := acquireAuthToken(tenantID)
-	if err != nil {
-		return nil, errors.New("Failed to acquire auth token: " + err.Error())
+	buf, err := sendRequest(tenantID, "GET", activeCloud.ResourceManagerEndpoint+userSettingsPath, nil)
+	if e, ok := err.(*armError); ok && e.StatusCode == http.StatusNotFound {
+		return nil, newError(notSetUpFailure, err, "Cloud Shell is not set up. Run '%s setup' or navigate to https://shell.azure.com to complete account setup", os.Args[0])
 	}
-
-	req.Header.Set("Authorization", token)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", userAgent)
-
-	response, err := client.Do(req)
 	if err != nil {
-		return nil, errors.New("Request failed. Failed to read user settings: " + err.Error())
+		return nil, newError(provisioningFailure, err, "Request failed. Failed to read user settings")
 	}
 
-	defer response.Body.Close()
-	buf, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, errors.New("Request failed. Failed to read user settings: " + err.Error())
+	resp := CloudShellSettings{}
+	if err := json.Unmarshal(buf, &resp); err != nil {
+		return nil, newError(provisioningFailure, err, "Failed to parse user settings")
 	}
 
-	resp := CloudShellSettings{}
-	json.Unmarshal(buf, &resp)
 	return &resp, nil
 }
 
-// RequestCloudShell requests a cloud shell instance
-func RequestCloudShell(tenantID string) (string, error) {
+// RequestCloudShell requests a cloud shell instance and waits until it is
+// provisioned, for timeout at most. The location is a preferred region, or
+// empty to leave the choice to Cloud Shell.
+func RequestCloudShell(tenantID, location string, timeout time.Duration) (string, error) {
 	consoleReq := &consoleRequest{
 		Properties: consoleRequestProperties{
 			OsType: "linux",
@@ -107,40 +117,181 @@ func RequestCloudShell(tenantID string) (string, error) {
 		return "", errors.New("Failed to serialize: " + err.Error())
 	}
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("PUT", resourceURI, bytes.NewReader([]byte(reqBody)))
+	header := http.Header{}
+	if location != "" {
+		log.Printf("Requesting Cloud Shell in %s...", location)
+		header.Set(preferredLocationHeader, location)
+	} else {
+		log.Printf("Requesting Cloud Shell...")
+	}
 
-	token, err := acquireAuthToken(tenantID)
+	header, buf, err := sendRequestWithHeader(tenantID, "PUT", activeCloud.ResourceManagerEndpoint+consolePath, header, reqBody)
 	if err != nil {
-		return "", errors.New("Failed to acquire auth token: " + err.Error())
+		return "", newError(provisioningFailure, err, "Failed to request Cloud Shell")
 	}
 
-	log.Printf("Requesting Cloud Shell...")
+	resp := consoleResponse{}
+	if err := json.Unmarshal(buf, &resp); err != nil {
+		return "", newError(provisioningFailure, err, "Failed to parse console response")
+	}
 
-	req.Header.Set("Authorization", token)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", userAgent)
+	if !strings.EqualFold(resp.Properties.ProvisioningState, "Succeeded") {
+		if resp, err = waitForConsole(tenantID, header, resp, timeout); err != nil {
+			return "", err
+		}
+	}
 
-	response, err := client.Do(req)
-	if err != nil {
-		return "", errors.New("Request failed: " + err.Error())
+	log.Printf("Succeeded.")
+
+	if resp.Properties.URI == "" {
+		return "", newError(provisioningFailure, nil, "Cloud Shell returned no console (provisioning state '%s')", resp.Properties.ProvisioningState)
+	}
+
+	return resp.Properties.URI, nil
+}
+
+// RequestCloudShellIn requests a cloud shell in the first of the locations
+// that has capacity, in order
+func RequestCloudShellIn(tenantID string, locations []string, timeout time.Duration) (string, error) {
+	if len(locations) == 0 {
+		return RequestCloudShell(tenantID, "", timeout)
+	}
+
+	for i, location := range locations {
+		uri, err := RequestCloudShell(tenantID, location, timeout)
+		if err == nil || !isCapacityError(err) || i == len(locations)-1 {
+			return uri, err
+		}
+
+		log.Printf("No capacity in %s, trying %s: %v", location, locations[i+1], err)
+	}
+
+	return "", nil
+}
+
+// parseLocations reads a comma separated list of regions, e.g. "westeurope, northeurope"
+func parseLocations(value string) ([]string, error) {
+	locations := []string{}
+	for _, l := range strings.Split(value, ",") {
+		l = strings.ToLower(strings.Replace(l, " ", "", -1))
+		if l == "" {
+			continue
+		}
+
+		if !locationPattern.MatchString(l) {
+			return nil, fmt.Errorf("invalid location '%s', use region names such as westeurope", l)
+		}
+
+		locations = append(locations, l)
+	}
+
+	for _, l := range locations {
+		if l == autoLocation && len(locations) > 1 {
+			return nil, fmt.Errorf("location %s cannot be combined with other regions", autoLocation)
+		}
 	}
 
-	defer response.Body.Close()
-	buf, err := ioutil.ReadAll(response.Body)
+	return locations, nil
+}
+
+// isCapacityError tells if a console request failed because the region has
+// no capacity, so that another region may succeed
+func isCapacityError(err error) bool {
+	var armErr *armError
+	if errors.As(err, &armErr) {
+		if armErr.StatusCode == http.StatusServiceUnavailable {
+			return true
+		}
+
+		return strings.Contains(strings.ToLower(armErr.Code+armErr.Message), "capacity")
+	}
+
+	var info *errorInfo
+	if errors.As(err, &info) {
+		return strings.Contains(strings.ToLower(info.Code+info.Message), "capacity")
+	}
+
+	return false
+}
+
+// sendRequest sends an authenticated request and returns the response body.
+// A conditional access claims challenge is answered by signing in again, then
+// the request is retried once.
+func sendRequest(tenantID, method, uri string, body []byte) ([]byte, error) {
+	_, buf, err := sendRequestWithHeader(tenantID, method, uri, nil, body)
+	return buf, err
+}
+
+// sendRequestWithHeader is sendRequest with additional request headers, also
+// returning the response headers
+func sendRequestWithHeader(tenantID, method, uri string, header http.Header, body []byte) (http.Header, []byte, error) {
+	token, err := credentials.Token(tenantID, activeCloud.ResourceManagerAudience)
 	if err != nil {
-		return "", errors.New("Request failed: " + err.Error())
+		return nil, nil, newError(authFailure, err, "Failed to acquire auth token")
 	}
 
-	resp := consoleResponse{}
-	json.Unmarshal(buf, &resp)
+	for retried := false; ; retried = true {
+		client := &http.Client{}
+		req, _ := http.NewRequest(method, uri, bytes.NewReader(body))
+
+		req.Header.Set("Authorization", token)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", userAgent)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		response, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		buf, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if claims, ok := parseClaimsChallenge(response); ok && !retried {
+			if token, err = answerClaimsChallenge(tenantID, claims); err != nil {
+				return nil, nil, newError(authFailure, err, "Failed to satisfy the claims challenge")
+			}
+
+			continue
+		}
+
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return nil, nil, responseError(response, buf)
+		}
+
+		return response.Header, buf, nil
+	}
+}
 
-	if strings.EqualFold(resp.Properties.ProvisioningState, "Succeeded") {
-		log.Printf("Succeeded.")
+// resourceTokens acquires the Graph and Key Vault tokens handed to Cloud Shell
+// with the terminal request, later ones are served by the tokenChannel.
+// A resource that cannot be signed in to is skipped, the session works without
+// it, so it is not worth another login prompt either.
+func resourceTokens(tenantID string) []string {
+	provider := nonInteractiveCredentials()
+
+	tokens := []string{}
+	for _, resource := range []string{activeCloud.GraphAudience, activeCloud.KeyVaultAudience} {
+		if resource == "" {
+			continue
+		}
+
+		token, err := provider.Token(tenantID, resource)
+		if err != nil {
+			log.Printf("Skipping login to %s: %v", resource, err)
+			continue
+		}
+
+		tokens = append(tokens, token[strings.Index(token, " ")+1:])
 	}
 
-	return resp.Properties.URI, nil
+	return tokens
 }
 
 // Resize resizes a terminal
@@ -149,7 +300,7 @@ func (t *Terminal) Resize(size *term.Winsize) error {
 	client := &http.Client{}
 	req, _ := http.NewRequest("POST", requestURI, bytes.NewReader([]byte("")))
 
-	token, err := acquireAuthToken(t.TenantID)
+	token, err := credentials.Token(t.TenantID, activeCloud.ResourceManagerAudience)
 	if err != nil {
 		return errors.New("Failed to acquire auth token: " + err.Error())
 	}
@@ -170,34 +321,27 @@ func (t *Terminal) Resize(size *term.Winsize) error {
 // RequestTerminal request a terminal in cloud shell instance
 func RequestTerminal(tenantID, URI, shellType string) (*Terminal, error) {
 	requestURI := URI + "/terminals?cols=120&rows=80&version=2019-01-01&shell=" + shellType
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", requestURI, bytes.NewReader([]byte("")))
 
-	token, err := acquireAuthToken(tenantID)
+	reqBody, err := json.Marshal(terminalRequest{Tokens: resourceTokens(tenantID)})
 	if err != nil {
-		return nil, errors.New("Failed to acquire auth token: " + err.Error())
+		return nil, errors.New("Failed to serialize: " + err.Error())
 	}
 
 	log.Printf("Connecting terminal (%s)...", shellType)
 
-	req.Header.Set("Authorization", token)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", userAgent)
-
-	response, err := client.Do(req)
+	buf, err := sendRequest(tenantID, "POST", requestURI, reqBody)
 	if err != nil {
-		return nil, errors.New("Request failed: " + err.Error())
+		return nil, newError(terminalFailure, err, "Failed to connect to cloud shell terminal")
 	}
 
-	defer response.Body.Close()
-	buf, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, errors.New("Request failed: " + err.Error())
+	t := &Terminal{BaseURI: URI, TenantID: tenantID}
+	if err := json.Unmarshal(buf, t); err != nil {
+		return nil, newError(terminalFailure, err, "Failed to parse terminal response")
 	}
 
-	t := &Terminal{BaseURI: URI, TenantID: tenantID}
-	json.Unmarshal(buf, t)
+	if t.SocketURI == "" {
+		return nil, newError(terminalFailure, nil, "Cloud Shell returned no terminal socket")
+	}
 
 	return t, nil
 }
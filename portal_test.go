@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+var parseLocationsTests = []struct {
+	value   string
+	want    []string
+	wantErr bool
+}{
+	{value: "", want: []string{}},
+	{value: "westeurope", want: []string{"westeurope"}},
+	{value: "westeurope, North Europe", want: []string{"westeurope", "northeurope"}},
+	{value: "westeurope,,northeurope,", want: []string{"westeurope", "northeurope"}},
+	{value: "auto", want: []string{"auto"}},
+	{value: "auto,westeurope", wantErr: true},
+	{value: "west-europe", wantErr: true},
+}
+
+func TestParseLocations(t *testing.T) {
+	for _, test := range parseLocationsTests {
+		got, err := parseLocations(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseLocations(%q) error %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseLocations(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+var capacityErrorTests = []struct {
+	err  error
+	want bool
+}{
+	{&armError{StatusCode: http.StatusServiceUnavailable}, true},
+	{&armError{StatusCode: http.StatusConflict, Code: "RegionCapacityExceeded"}, true},
+	{&armError{StatusCode: http.StatusBadRequest, Message: "No capacity left in westeurope"}, true},
+	{&armError{StatusCode: http.StatusBadRequest, Code: "InvalidLocation"}, false},
+	{newError(provisioningFailure, &errorInfo{Code: "OutOfCapacity"}, "Cloud Shell provisioning failed"), true},
+	{newError(provisioningFailure, &errorInfo{Code: "StorageAccountNotFound"}, "Cloud Shell provisioning failed"), false},
+	{errors.New("capacity"), false},
+	{nil, false},
+}
+
+func TestIsCapacityError(t *testing.T) {
+	for _, test := range capacityErrorTests {
+		if got := isCapacityError(test.err); got != test.want {
+			t.Errorf("isCapacityError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/term"
+)
+
+const (
+	defaultProvisionTimeout = 5 * time.Minute
+	defaultPollInterval     = 2 * time.Second
+	maxPollInterval         = 30 * time.Second
+)
+
+// asyncOperation is the status document behind an Azure-AsyncOperation header
+type asyncOperation struct {
+	Status string     `json:"status"`
+	Error  *errorInfo `json:"error"`
+}
+
+// waitForConsole polls a console that is still provisioning until it
+// succeeds, fails or the timeout passes. The Azure-AsyncOperation status is
+// followed when the service returns one, the console itself otherwise.
+func waitForConsole(tenantID string, header http.Header, console consoleResponse, timeout time.Duration) (consoleResponse, error) {
+	stop := startSpinner("Provisioning Cloud Shell")
+	defer stop()
+
+	deadline := time.Now().Add(timeout)
+	operationURI := header.Get("Azure-AsyncOperation")
+	if operationURI != "" && !isResourceManagerURL(operationURI) {
+		// The request carries the Resource Manager token, never send it elsewhere
+		log.Printf("Ignoring the provisioning status at %s, it is not a Resource Manager URL", operationURI)
+		operationURI = ""
+	}
+
+	for {
+		state := console.Properties.ProvisioningState
+		if operationURI != "" {
+			h, buf, err := sendRequestWithHeader(tenantID, "GET", operationURI, nil, nil)
+			if err != nil {
+				return console, newError(provisioningFailure, err, "Failed to read the provisioning status")
+			}
+
+			var op asyncOperation
+			if err := json.Unmarshal(buf, &op); err != nil {
+				return console, newError(provisioningFailure, err, "Failed to parse the provisioning status")
+			}
+
+			state, header = op.Status, h
+			if op.Error != nil {
+				console.Properties.Error = op.Error
+			}
+		}
+
+		switch {
+		case strings.EqualFold(state, "Succeeded"):
+			if operationURI != "" || console.Properties.URI == "" {
+				return readConsole(tenantID)
+			}
+			return console, nil
+		case strings.EqualFold(state, "Failed"), strings.EqualFold(state, "Canceled"):
+			return console, provisioningError(state, console.Properties.Error)
+		}
+
+		if time.Now().After(deadline) {
+			return console, newError(provisioningFailure, nil, "Cloud Shell was not ready after %v (provisioning state '%s')", timeout, state)
+		}
+
+		time.Sleep(retryAfter(header))
+
+		if operationURI == "" {
+			h, buf, err := sendRequestWithHeader(tenantID, "GET", activeCloud.ResourceManagerEndpoint+consolePath, nil, nil)
+			if err != nil {
+				return console, newError(provisioningFailure, err, "Failed to read the console")
+			}
+
+			console = consoleResponse{}
+			if err := json.Unmarshal(buf, &console); err != nil {
+				return console, newError(provisioningFailure, err, "Failed to parse console response")
+			}
+			header = h
+		}
+	}
+}
+
+// isResourceManagerURL tells if a URL is a https URL of the Resource Manager
+// host of the active cloud, or one of its regional hosts
+func isResourceManagerURL(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	armHost := strings.ToLower(activeCloud.resourceManagerHost())
+	return host == armHost || strings.HasSuffix(host, "."+armHost)
+}
+
+func readConsole(tenantID string) (consoleResponse, error) {
+	console := consoleResponse{}
+	buf, err := sendRequest(tenantID, "GET", activeCloud.ResourceManagerEndpoint+consolePath, nil)
+	if err != nil {
+		return console, newError(provisioningFailure, err, "Failed to read the console")
+	}
+
+	if err := json.Unmarshal(buf, &console); err != nil {
+		return console, newError(provisioningFailure, err, "Failed to parse console response")
+	}
+
+	return console, nil
+}
+
+func provisioningError(state string, info *errorInfo) error {
+	if info == nil {
+		return newError(provisioningFailure, nil, "Cloud Shell provisioning %s", strings.ToLower(state))
+	}
+
+	return newError(provisioningFailure, info, "Cloud Shell provisioning %s", strings.ToLower(state))
+}
+
+// retryAfter reads the Retry-After header, in seconds or as a date
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	wait := defaultPollInterval
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		wait = time.Until(t)
+	}
+
+	if wait <= 0 {
+		return defaultPollInterval
+	}
+	if wait > maxPollInterval {
+		return maxPollInterval
+	}
+
+	return wait
+}
+
+// startSpinner shows a spinner with the elapsed time on stderr until the
+// returned function is called. Nothing is shown when stderr is not a terminal.
+func startSpinner(message string) func() {
+	if !term.IsTerminal(os.Stderr.Fd()) {
+		return func() {}
+	}
+
+	frames := []string{"|", "/", "-", "\\"}
+	start := time.Now()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			fmt.Fprintf(os.Stderr, "\r%s %s (%ds)", frames[i%len(frames)], message, int(time.Since(start).Seconds()))
+
+			select {
+			case <-done:
+				fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", len(message)+16))
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
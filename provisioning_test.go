@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+var retryAfterTests = []struct {
+	value string
+	want  time.Duration
+}{
+	{"", defaultPollInterval},
+	{"5", 5 * time.Second},
+	{"0", defaultPollInterval},
+	{"-3", defaultPollInterval},
+	{"3600", maxPollInterval},
+	{"soon", defaultPollInterval},
+	{"Mon, 02 Jan 2006 15:04:05 GMT", defaultPollInterval},
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, test := range retryAfterTests {
+		header := http.Header{}
+		if test.value != "" {
+			header.Set("Retry-After", test.value)
+		}
+
+		if got := retryAfter(header); got != test.want {
+			t.Errorf("retryAfter(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+
+	// A date in the future waits until then
+	header := http.Header{"Retry-After": {time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)}}
+	if got := retryAfter(header); got <= 5*time.Second || got > 10*time.Second {
+		t.Errorf("retryAfter(%q) = %v, want about 10s", header.Get("Retry-After"), got)
+	}
+}
+
+var resourceManagerURLTests = []struct {
+	cloud cloudEnvironment
+	uri   string
+	want  bool
+}{
+	{azurePublicCloud, "https://management.azure.com/providers/Microsoft.Portal/operationresults/1", true},
+	{azurePublicCloud, "https://MANAGEMENT.AZURE.COM/operationresults/1", true},
+	{azurePublicCloud, "https://westeurope.management.azure.com/operationresults/1", true},
+	{azurePublicCloud, "http://management.azure.com/operationresults/1", false},
+	{azurePublicCloud, "https://management.azure.com.attacker.example/operationresults/1", false},
+	{azurePublicCloud, "https://evilmanagement.azure.com/operationresults/1", false},
+	{azurePublicCloud, "https://management.chinacloudapi.cn/operationresults/1", false},
+	{azureChinaCloud, "https://management.chinacloudapi.cn/operationresults/1", true},
+	{azurePublicCloud, "://bad", false},
+}
+
+func TestIsResourceManagerURL(t *testing.T) {
+	defer func(c cloudEnvironment) { activeCloud = c }(activeCloud)
+
+	for _, test := range resourceManagerURLTests {
+		activeCloud = test.cloud
+		if got := isResourceManagerURL(test.uri); got != test.want {
+			t.Errorf("isResourceManagerURL(%q) in %s = %v, want %v", test.uri, test.cloud.Name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A minimal QR code encoder for the device login URL: byte mode, error
+// correction level L, versions 1 to 10 (up to 271 bytes).
+
+// qrBlocks is the error correction layout of a version at level L
+type qrBlocks struct {
+	ecPerBlock int
+	blocks     []int // data codewords of each block
+}
+
+var qrVersionsL = []qrBlocks{
+	{7, []int{19}},
+	{10, []int{34}},
+	{15, []int{55}},
+	{20, []int{80}},
+	{26, []int{108}},
+	{18, []int{68, 68}},
+	{20, []int{78, 78}},
+	{24, []int{97, 97}},
+	{30, []int{116, 116}},
+	{18, []int{68, 68, 69, 69}},
+}
+
+var qrAlignmentPositions = [][]int{
+	{},
+	{6, 18},
+	{6, 22},
+	{6, 26},
+	{6, 30},
+	{6, 34},
+	{6, 22, 38},
+	{6, 24, 42},
+	{6, 26, 46},
+	{6, 28, 50},
+}
+
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// encodeQRCode encodes the text with the smallest version that fits
+func encodeQRCode(text string) (*qrCode, error) {
+	data := []byte(text)
+	for v := 1; v <= len(qrVersionsL); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+
+		capacity := 0
+		for _, n := range qrVersionsL[v-1].blocks {
+			capacity += n
+		}
+
+		if 4+countBits+8*len(data) <= capacity*8 {
+			return newQRCode(v, qrCodewords(v, qrDataCodewords(data, countBits, capacity))), nil
+		}
+	}
+
+	return nil, fmt.Errorf("text of %d bytes is too long for a QR code", len(data))
+}
+
+// qrDataCodewords packs the data in byte mode, padded to the capacity
+func qrDataCodewords(data []byte, countBits, capacity int) []byte {
+	bits := []bool{}
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value>>uint(i))&1 == 1)
+		}
+	}
+
+	appendBits(0x4, 4)
+	appendBits(len(data), countBits)
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << uint(7-j)
+			}
+		}
+		codewords = append(codewords, b)
+	}
+
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	return codewords
+}
+
+// qrCodewords splits the data into blocks, adds their error correction and
+// interleaves them
+func qrCodewords(version int, data []byte) []byte {
+	layout := qrVersionsL[version-1]
+	divisor := reedSolomonDivisor(layout.ecPerBlock)
+
+	blocks := [][]byte{}
+	ecBlocks := [][]byte{}
+	for _, n := range layout.blocks {
+		blocks = append(blocks, data[:n])
+		ecBlocks = append(ecBlocks, reedSolomonRemainder(data[:n], divisor))
+		data = data[n:]
+	}
+
+	result := []byte{}
+	for i := 0; i < layout.blocks[len(layout.blocks)-1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				result = append(result, b[i])
+			}
+		}
+	}
+
+	for i := 0; i < layout.ecPerBlock; i++ {
+		for _, b := range ecBlocks {
+			result = append(result, b[i])
+		}
+	}
+
+	return result
+}
+
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+
+	return byte(z)
+}
+
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+
+	return result
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+
+	return result
+}
+
+func newQRCode(version int, codewords []byte) *qrCode {
+	q := &qrCode{size: 17 + 4*version}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					d := maxInt(absInt(dx), absInt(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	positions := qrAlignmentPositions[version-1]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas, the real bits are drawn after masking
+	q.drawFormatBits(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+func (q *qrCode) drawFormatBits(mask int) {
+	// Error correction level L is 01
+	data := 1<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawCodewords places the bits in the zigzag order of the QR specification
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.modules[y][x] = (codewords[i>>3]>>uint(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores a masked symbol by the rules of the QR specification, lower is better
+func (q *qrCode) penalty() int {
+	penalty := 0
+	dark := 0
+	finderLike := []bool{true, false, true, true, true, false, true}
+
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	for i := 0; i < q.size; i++ {
+		row := make([]bool, q.size)
+		column := make([]bool, q.size)
+		for j := 0; j < q.size; j++ {
+			row[j] = q.modules[i][j]
+			column[j] = q.modules[j][i]
+		}
+
+		for _, line := range [][]bool{row, column} {
+			run := 1
+			for j := 1; j <= len(line); j++ {
+				if j < len(line) && line[j] == line[j-1] {
+					run++
+					continue
+				}
+
+				if run >= 5 {
+					penalty += 3 + run - 5
+				}
+				run = 1
+			}
+
+			for j := 0; j+len(finderLike) <= len(line); j++ {
+				if !qrMatches(line[j:j+len(finderLike)], finderLike) {
+					continue
+				}
+
+				if qrLight(line, j-4, j) || qrLight(line, j+len(finderLike), j+len(finderLike)+4) {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	total := q.size * q.size
+	penalty += absInt(dark*20-total*10) / total * 10
+	return penalty
+}
+
+func qrMatches(a, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// qrLight tells if the modules from start to end are light, outside the symbol counts as light
+func qrLight(line []bool, start, end int) bool {
+	for i := start; i < end; i++ {
+		if i >= 0 && i < len(line) && line[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// render draws the symbol with half block characters, two modules per line,
+// in black on white so it scans on dark and light terminals alike.
+func (q *qrCode) render() string {
+	const quiet = 2
+	dark := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && x < q.size && y >= 0 && y < q.size && q.modules[y][x]
+	}
+
+	var sb strings.Builder
+	width := q.size + 2*quiet
+	for y := 0; y < width; y += 2 {
+		sb.WriteString("\x1b[30;47m")
+		for x := 0; x < width; x++ {
+			top, bottom := dark(x, y), dark(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\x1b[0m\n")
+	}
+
+	return sb.String()
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
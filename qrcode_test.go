@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The golden symbols were generated by rsc.io/qr/coding at error correction
+// level L, with the version and mask encodeQRCode selects. '#' is a dark module.
+var qrGoldenTests = []struct {
+	text    string
+	version int
+	mask    int
+	modules string
+}{
+	{
+		text:    "https://microsoft.com/devicelogin",
+		version: 3,
+		mask:    5,
+		modules: `
+#######..###.###.##...#######
+#.....#....##..#....#.#.....#
+#.###.#..###..#.#.###.#.###.#
+#.###.#.#.##..##.#.##.#.###.#
+#.###.#.#.#.####..##..#.###.#
+#.....#..##..##.#...#.#.....#
+#######.#.#.#.#.#.#.#.#######
+.........#..##......#........
+##...###.##.#.##.#.#....##...
+.##....#..#...#....#...##.##.
+..##.###.#.##....#..#.#......
+#....#....##..###.#####.##...
+####..##.##..##.#...#.#.....#
+..#.##.#..#.###..########..##
+#.##.#####...###..#.##.#.##..
+.#...#.#..#.####...###..#.#.#
+####.####.#.#.#..#.......##..
+###..#..#......##.###.###.###
+###.#.##..#.####..###...##..#
+#........###..#....####......
+#..#########.....#.######.###
+........###.##.#..#.#...##...
+#######.#.#..####..##.#.###..
+#.....#.###.##.##...#...#..#.
+#.###.#...####.##..#######.##
+#.###.#..#.....####..#...##.#
+#.###.#..####..##..#.#######.
+#.....#.#..#...#..##.######.#
+#######.##.#.....#.#.###..#..
+`,
+	},
+	{
+		// Two blocks and the version information of versions 7 and above
+		text:    "https://login.microsoftonline.com/72f988bf-86f1-41af-91ab-2d7cd011db47/oauth2/v2.0/devicecode?client_id=aebc6443-996d-45c2-90f0-388ff96faa56",
+		version: 7,
+		mask:    2,
+		modules: `
+#######...##.#.#...#.#.#.#.#..##.#..#.#######
+#.....#.##...#...#..##..#.###..#.#.#..#.....#
+#.###.#..##.#..#.###.#..#####.#.##.#..#.###.#
+#.###.#.###.#...#.#.######.#...#...##.#.###.#
+#.###.#..#..####.#..#####..#.###..###.#.###.#
+#.....#.#....######.#...###....#.#....#.....#
+#######.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#######
+............#.##....#...#...##..#.##.........
+#####.###.#..###.########.##...#..#..#.#.#.#.
+....##..##..#...#....#.#.#.#.##.#..###..##.##
+#..#.##.....##.##.###...#.###..##.#...#....#.
+..#.##.##.#.###.#........#.##.#.###.##.##.#..
+.#.#######.....#####.####....#.#.....#...#.#.
+..#..#......#.#.....#.##...##.##...###..#.#.#
+###.#.#.#...#..#..#.#...###..#...###..##..#..
+#...#..#..#.##...###.#.###..#.#.##..#.#####.#
+##.#..#.##.......###..##..##.#.#..##.#...#...
+#####..#.#####.#.....#.......###...###..#.###
+.#.##.#...#####..####..##.###...####..#.#.##.
+...#.#...#.#.###..#.....##..###.#...#..##.#..
+....#######..#.##.#.######.#...#....#####..#.
+...##...#..##.#..#.##...##....##...##...#.###
+###.#.#.###.###...###.#.#.####.######.#.##...
+##..#...##.#..##.##.#...###.##..#.#.#...#.#.#
+##.######..#####..#.######.#.#.#..########.#.
+.#####..#.#.#...##.####.#..####....#.##..#.##
+##..######.########.##...##....#######...#.#.
+#.##....###.###.##....#.#...#####.##..#####..
+..#...##...#.#..###..#.#####..#..##..####...#
+.#.#...###..#.##...##.#.#.....#.....#.#....##
+#.....##.##.#....##....#.#####.#..##...#...#.
+###..#..###..#.#.######.#.####..#..##.#.#.###
+......##....#.....#.##.##....###.##..####..##
+.##..#..#..#.#.#.#.#.##....##.#.#....##..##.#
+....#.##..#.......#.####.###...##.#.##.##.##.
+.####...#..#.#.#.#...#..#...###.#..#..#..##..
+#..##.#......#..#########.##..##.#..#####..##
+........#..#####....#...#.....##...##...##..#
+#######.#...####.####.#.#.#.##..#...#.#.##...
+#.....#..####.##...##...##..##..#..##...#.#.#
+#.###.#.##.#####..#.#####.##.#.#.#.######....
+#.###.#.##..#...#.#..#...#..#.###....######..
+#.###.#.#..###.####.#.###.#..#.######.#..##.#
+#.....#.###.##..#.###.##.####.#.#.#.##..###..
+#######.##.#.#..#.#.....##.#.#.#..###.#.##.#.
+`,
+	},
+}
+
+func TestEncodeQRCodeGolden(t *testing.T) {
+	for _, test := range qrGoldenTests {
+		q, err := encodeQRCode(test.text)
+		if err != nil {
+			t.Fatalf("encodeQRCode(%q) failed: %v", test.text, err)
+		}
+
+		if want := 17 + 4*test.version; q.size != want {
+			t.Fatalf("encodeQRCode(%q) has size %d, want %d (version %d)", test.text, q.size, want, test.version)
+		}
+
+		if mask := qrFormatMask(q); mask != test.mask {
+			t.Errorf("encodeQRCode(%q) chose mask %d, want %d", test.text, mask, test.mask)
+		}
+
+		want := strings.Split(strings.TrimSpace(test.modules), "\n")
+		for y, row := range q.modules {
+			got := ""
+			for _, dark := range row {
+				if dark {
+					got += "#"
+				} else {
+					got += "."
+				}
+			}
+
+			if got != want[y] {
+				t.Errorf("encodeQRCode(%q) row %d:\n got  %s\n want %s", test.text, y, got, want[y])
+			}
+		}
+	}
+}
+
+// qrFormatMask reads the mask back from the format bits in row 8 beside the
+// top left finder pattern, bits 10 to 14 hold the level and the mask
+func qrFormatMask(q *qrCode) int {
+	bits := 0
+	for i := 10; i < 15; i++ {
+		if q.modules[8][14-i] {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return (bits ^ 0x5412) >> 10 & 7
+}
+
+func TestEncodeQRCodeTooLong(t *testing.T) {
+	if _, err := encodeQRCode(strings.Repeat("x", 272)); err == nil {
+		t.Error("encodeQRCode of 272 bytes succeeded, want an error")
+	}
+}
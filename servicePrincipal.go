@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"golang.org/x/crypto/pkcs12"
+)
+
+const (
+	tenantIDEnvVar              = "AZURE_TENANT_ID"
+	clientIDEnvVar              = "AZURE_CLIENT_ID"
+	clientSecretEnvVar          = "AZURE_CLIENT_SECRET"
+	clientCertificatePathEnvVar = "AZURE_CLIENT_CERTIFICATE_PATH"
+	clientCertPasswordEnvVar    = "AZURE_CLIENT_CERTIFICATE_PASSWORD"
+)
+
+// applicationTenant resolves the common tenant to the tenant given with --tenant
+// or AZURE_TENANT_ID, since an application cannot sign in to the common tenant.
+func applicationTenant(tenantID string) (string, error) {
+	if tenantID != commonTenant {
+		return tenantID, nil
+	}
+
+	tenantID = firstNonEmpty(authFlags.tenantID, os.Getenv(tenantIDEnvVar))
+	if tenantID == "" {
+		return "", fmt.Errorf("application login requires --tenant or %s", tenantIDEnvVar)
+	}
+
+	return tenantID, nil
+}
+
+// servicePrincipalTokenProvider signs in as a service principal with a client
+// secret or certificate. Tokens are kept in memory and renewed when close to expiry.
+type servicePrincipalTokenProvider struct {
+	mu     sync.Mutex
+	tokens map[string]*adal.ServicePrincipalToken
+}
+
+func (p *servicePrincipalTokenProvider) Name() string {
+	return "serviceprincipal"
+}
+
+func (p *servicePrincipalTokenProvider) Token(tenantID, resource string) (string, error) {
+	clientID := firstNonEmpty(authFlags.clientID, os.Getenv(clientIDEnvVar))
+	secret := firstNonEmpty(authFlags.clientSecret, os.Getenv(clientSecretEnvVar))
+	certPath := firstNonEmpty(authFlags.clientCertificatePath, os.Getenv(clientCertificatePathEnvVar))
+
+	if clientID == "" || (secret == "" && certPath == "") {
+		return "", credentialUnavailable("%s and %s or %s are not set", clientIDEnvVar, clientSecretEnvVar, clientCertificatePathEnvVar)
+	}
+
+	tenantID, err := applicationTenant(tenantID)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := strings.ToLower(tenantID + "/" + resource)
+	spt, ok := p.tokens[key]
+	if !ok {
+		oauthConfig, err := adal.NewOAuthConfig(activeCloud.ActiveDirectoryEndpoint, tenantID)
+		if err != nil {
+			return "", err
+		}
+
+		if secret != "" {
+			spt, err = adal.NewServicePrincipalToken(*oauthConfig, clientID, secret, resource)
+		} else {
+			spt, err = newServicePrincipalTokenFromCertificateFile(*oauthConfig, clientID, certPath, resource)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("failed to create service principal token: %v", err)
+		}
+
+		if p.tokens == nil {
+			p.tokens = map[string]*adal.ServicePrincipalToken{}
+		}
+		p.tokens[key] = spt
+	}
+
+	if err := spt.EnsureFresh(); err != nil {
+		return "", fmt.Errorf("failed to acquire token for service principal %s: %v", clientID, err)
+	}
+
+	return authorizationHeader(spt.Token()), nil
+}
+
+// newServicePrincipalTokenFromCertificateFile signs in with a PEM certificate,
+// or a PFX (PKCS#12) certificate when the file extension is .pfx or .p12
+func newServicePrincipalTokenFromCertificateFile(oauthConfig adal.OAuthConfig, clientID, path, resource string) (*adal.ServicePrincipalToken, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate %s: %v", path, err)
+	}
+
+	var certificate *x509.Certificate
+	var privateKey *rsa.PrivateKey
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".pfx" || ext == ".p12" {
+		password := firstNonEmpty(authFlags.clientCertificatePassword, os.Getenv(clientCertPasswordEnvVar))
+		certificate, privateKey, err = parsePFXCertificate(buf, password)
+	} else {
+		certificate, privateKey, err = parsePEMCertificate(buf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %s: %v", path, err)
+	}
+
+	return adal.NewServicePrincipalTokenFromCertificate(oauthConfig, clientID, certificate, privateKey, resource)
+}
+
+// parsePFXCertificate reads the certificate and RSA private key from PKCS#12 data
+func parsePFXCertificate(data []byte, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if _, ok := err.(pkcs12.NotImplementedError); ok {
+		return nil, nil, fmt.Errorf("%v, only PFX files with the legacy 3DES or RC2 encryption are supported (openssl pkcs12 -export -legacy)", err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificates := []*x509.Certificate{}
+	var privateKey *rsa.PrivateKey
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certificates = append(certificates, cert)
+		case "PRIVATE KEY":
+			// ToPEM converts RSA keys to PKCS#1, whatever the block type says
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("private key is not an RSA key: %v", err)
+			}
+			privateKey = key
+		}
+	}
+
+	if privateKey == nil {
+		return nil, nil, fmt.Errorf("no RSA private key found")
+	}
+
+	certificate := matchingCertificate(certificates, privateKey)
+	if certificate == nil {
+		return nil, nil, fmt.Errorf("no certificate found for the private key")
+	}
+
+	return certificate, privateKey, nil
+}
+
+// matchingCertificate returns the certificate of the private key. A PFX file
+// usually holds the whole chain, in no particular order.
+func matchingCertificate(certificates []*x509.Certificate, privateKey *rsa.PrivateKey) *x509.Certificate {
+	for _, cert := range certificates {
+		if publicKey, ok := cert.PublicKey.(*rsa.PublicKey); ok && publicKey.N.Cmp(privateKey.N) == 0 && publicKey.E == privateKey.E {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+// parsePEMCertificate reads the first certificate and RSA private key from PEM data
+func parsePEMCertificate(data []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	var certificate *x509.Certificate
+	var privateKey *rsa.PrivateKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			if certificate != nil {
+				continue
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certificate = cert
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			privateKey = key
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, nil, fmt.Errorf("private key is not an RSA key")
+			}
+			privateKey = rsaKey
+		}
+	}
+
+	if certificate == nil {
+		return nil, nil, fmt.Errorf("no certificate found")
+	}
+
+	if privateKey == nil {
+		return nil, nil, fmt.Errorf("no RSA private key found")
+	}
+
+	return certificate, privateKey, nil
+}
@@ -15,7 +15,16 @@ var (
 )
 
 type settings struct {
-	ActiveTenant string `json:"activeTenant"`
+	ActiveTenant      string   `json:"activeTenant"`
+	AuthMethods       []string `json:"authMethods,omitempty"`
+	CredentialProcess string   `json:"credentialProcess,omitempty"`
+	Cloud             string   `json:"cloud,omitempty"`
+	EncryptCache      bool     `json:"encryptCache,omitempty"`
+	CacheKeyFile      string   `json:"cacheKeyFile,omitempty"`
+	LoginEndpoint     string   `json:"loginEndpoint,omitempty"`
+
+	// Locations caches the regions measured for --location auto
+	Locations *locationCache `json:"locations,omitempty"`
 }
 
 func defaultSettingsPath() string {
@@ -66,6 +75,24 @@ func saveSettings(setting settings) error {
 	return nil
 }
 
+// updateSettings applies a change to the persisted settings. The settings file
+// stays locked from reading to saving, so concurrent updates are not lost.
+func updateSettings(update func(s *settings)) error {
+	unlock, err := lockFile(defaultSettingsPath())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := readSettings()
+	if err != nil {
+		return err
+	}
+
+	update(&s)
+	return saveSettings(s)
+}
+
 func readSettings() (setting settings, err error) {
 	path := defaultSettingsPath()
 	if _, err := os.Stat(path); err == nil {
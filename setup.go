@@ -0,0 +1,463 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/manifoldco/promptui"
+)
+
+const (
+	subscriptionsAPIVersion  = "2020-01-01"
+	resourceGroupsAPIVersion = "2021-04-01"
+	storageAPIVersion        = "2021-09-01"
+
+	createNewOption       = "(create new)"
+	storageCreateTimeout  = 5 * time.Minute
+	cloudShellShareQuota  = 6
+	cloudShellDiskSizeGiB = 5
+)
+
+var (
+	storageAccountNamePattern = regexp.MustCompile(`^[a-z0-9]{3,24}$`)
+	fileShareNamePattern      = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9]|-[a-z0-9]){2,62}$`)
+	resourceGroupNamePattern  = regexp.MustCompile(`^[-\w._()]{1,89}[-\w_()]$`)
+)
+
+// armResource is the part of an ARM resource the setup needs
+type armResource struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	Location    string `json:"location"`
+	State       string `json:"state"`
+
+	SubscriptionID string `json:"subscriptionId"`
+	Properties     struct {
+		ProvisioningState string `json:"provisioningState"`
+	} `json:"properties"`
+	Metadata struct {
+		RegionType string `json:"regionType"`
+	} `json:"metadata"`
+}
+
+type armResourceList struct {
+	Value    []armResource `json:"value"`
+	NextLink string        `json:"nextLink"`
+}
+
+// userSettingsRequest is the body of the cloudconsole userSettings PUT
+type userSettingsRequest struct {
+	Properties userSettingsRequestProperties `json:"properties"`
+}
+
+type userSettingsRequestProperties struct {
+	PreferredOsType    string          `json:"preferredOsType"`
+	PreferredLocation  string          `json:"preferredLocation"`
+	PreferredShellType string          `json:"preferredShellType"`
+	StorageProfile     *StorageProfile `json:"storageProfile"`
+	TerminalSettings   struct {
+		FontSize  string `json:"fontSize"`
+		FontStyle string `json:"fontStyle"`
+	} `json:"terminalSettings"`
+}
+
+func runSetup(args []string) error {
+	var authMethods, tenantID string
+
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	fs.StringVar(&tenantID, "tenant", "", "Tenant to set up Cloud Shell in (default the active tenant).")
+	addAuthFlags(fs, &authMethods)
+	fs.Parse(args)
+
+	authFlags.tenantID = tenantID
+	if err := configureCredentials(authMethods); err != nil {
+		return newError(usageFailure, err, "Invalid options")
+	}
+
+	if err := selectAccount(); err != nil {
+		return accountError(err)
+	}
+
+	tenantID, err := selectTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	subscription, err := pickSubscription(tenantID)
+	if err != nil {
+		return err
+	}
+
+	location, err := pickLocation(tenantID, subscription)
+	if err != nil {
+		return err
+	}
+
+	group, err := pickResourceGroup(tenantID, subscription, location)
+	if err != nil {
+		return err
+	}
+
+	account, err := pickStorageAccount(tenantID, group, location)
+	if err != nil {
+		return err
+	}
+
+	share, err := pickFileShare(tenantID, account)
+	if err != nil {
+		return err
+	}
+
+	shell, err := pickOption("Preferred Shell", []string{"bash", "pwsh"})
+	if err != nil {
+		return err
+	}
+
+	body := userSettingsRequest{}
+	body.Properties.PreferredOsType = "Linux"
+	body.Properties.PreferredLocation = location
+	body.Properties.PreferredShellType = shell
+	body.Properties.StorageProfile = &StorageProfile{
+		StorageAccountResourceID: account,
+		FileShareName:            share,
+		DiskSizeInGB:             cloudShellDiskSizeGiB,
+	}
+	body.Properties.TerminalSettings.FontSize = "Medium"
+	body.Properties.TerminalSettings.FontStyle = "Monospace"
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	if _, err := sendRequest(tenantID, "PUT", activeCloud.ResourceManagerEndpoint+userSettingsPath, buf); err != nil {
+		return newError(provisioningFailure, err, "Failed to save Cloud Shell settings")
+	}
+
+	fmt.Printf("Cloud Shell is set up with file share %s in %s. Run '%s' to connect.\n", share, account, os.Args[0])
+	return nil
+}
+
+func pickSubscription(tenantID string) (string, error) {
+	subscriptions, err := listResources(tenantID, "/subscriptions?api-version="+subscriptionsAPIVersion)
+	if err != nil {
+		return "", newError(provisioningFailure, err, "Failed to list subscriptions")
+	}
+
+	options := []string{}
+	ids := []string{}
+	for _, s := range subscriptions {
+		if s.State != "" && !strings.EqualFold(s.State, "Enabled") {
+			continue
+		}
+
+		options = append(options, fmt.Sprintf("%s (%s)", s.DisplayName, s.SubscriptionID))
+		ids = append(ids, s.SubscriptionID)
+	}
+
+	if len(ids) == 0 {
+		return "", newError(provisioningFailure, nil, "No enabled subscription found in tenant %s", tenantID)
+	}
+
+	index, err := pickIndex("Select Subscription", options)
+	if err != nil {
+		return "", err
+	}
+
+	return ids[index], nil
+}
+
+// pickLocation offers the regions of the subscription that Cloud Shell runs
+// in. In a cloud without a known list of regions, all physical regions are offered.
+func pickLocation(tenantID, subscription string) (string, error) {
+	locations, err := listResources(tenantID, fmt.Sprintf("/subscriptions/%s/locations?api-version=%s", subscription, subscriptionsAPIVersion))
+	if err != nil {
+		return "", newError(provisioningFailure, err, "Failed to list regions")
+	}
+
+	regions, known := cloudShellRegions[activeCloud.Name]
+
+	options := []string{}
+	names := []string{}
+	for _, l := range locations {
+		if known && !containsString(regions, l.Name) || !known && !strings.EqualFold(l.Metadata.RegionType, "Physical") {
+			continue
+		}
+
+		options = append(options, fmt.Sprintf("%s (%s)", l.DisplayName, l.Name))
+		names = append(names, l.Name)
+	}
+
+	if len(names) == 0 {
+		return "", newError(provisioningFailure, nil, "Subscription %s has no region Cloud Shell runs in", subscription)
+	}
+
+	index, err := pickIndex("Select Region", options)
+	if err != nil {
+		return "", err
+	}
+
+	return names[index], nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pickResourceGroup returns the resource Id of an existing or new resource group
+func pickResourceGroup(tenantID, subscription, location string) (string, error) {
+	groups, err := listResources(tenantID, fmt.Sprintf("/subscriptions/%s/resourcegroups?api-version=%s", subscription, resourceGroupsAPIVersion))
+	if err != nil {
+		return "", newError(provisioningFailure, err, "Failed to list resource groups")
+	}
+
+	options := []string{createNewOption}
+	for _, g := range groups {
+		options = append(options, fmt.Sprintf("%s (%s)", g.Name, g.Location))
+	}
+
+	index, err := pickIndex("Select Resource Group", options)
+	if err != nil {
+		return "", err
+	}
+
+	if index > 0 {
+		return groups[index-1].ID, nil
+	}
+
+	name, err := promptName("Resource group name", "cloud-shell-storage-"+location, resourceGroupNamePattern)
+	if err != nil {
+		return "", err
+	}
+
+	id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscription, name)
+	body := fmt.Sprintf(`{"location":%q}`, location)
+	if _, err := sendRequest(tenantID, "PUT", resourceURL(id, resourceGroupsAPIVersion), []byte(body)); err != nil {
+		return "", newError(provisioningFailure, err, "Failed to create resource group %s", name)
+	}
+
+	return id, nil
+}
+
+// pickStorageAccount returns the resource Id of an existing or new storage account
+func pickStorageAccount(tenantID, group, location string) (string, error) {
+	accounts, err := listResources(tenantID, fmt.Sprintf("%s/providers/Microsoft.Storage/storageAccounts?api-version=%s", group, storageAPIVersion))
+	if err != nil {
+		return "", newError(provisioningFailure, err, "Failed to list storage accounts")
+	}
+
+	options := []string{createNewOption}
+	for _, a := range accounts {
+		options = append(options, fmt.Sprintf("%s (%s)", a.Name, a.Location))
+	}
+
+	index, err := pickIndex("Select Storage Account", options)
+	if err != nil {
+		return "", err
+	}
+
+	if index > 0 {
+		return accounts[index-1].ID, nil
+	}
+
+	suffix, err := randomHex(6)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := promptName("Storage account name", "cs"+suffix, storageAccountNamePattern)
+	if err != nil {
+		return "", err
+	}
+
+	id := fmt.Sprintf("%s/providers/Microsoft.Storage/storageAccounts/%s", group, name)
+	body := fmt.Sprintf(`{"location":%q,"kind":"StorageV2","sku":{"name":"Standard_LRS"},"properties":{"minimumTlsVersion":"TLS1_2","supportsHttpsTrafficOnly":true}}`, location)
+	if _, err := sendRequest(tenantID, "PUT", resourceURL(id, storageAPIVersion), []byte(body)); err != nil {
+		return "", newError(provisioningFailure, err, "Failed to create storage account %s", name)
+	}
+
+	if err := waitForResource(tenantID, id, storageAPIVersion, "Creating storage account "+name); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// pickFileShare returns the name of an existing or new file share for the
+// home directory. A storage account without shares goes straight to creating one.
+func pickFileShare(tenantID, account string) (string, error) {
+	shares, err := listResources(tenantID, fmt.Sprintf("%s/fileServices/default/shares?api-version=%s", account, storageAPIVersion))
+	if err != nil {
+		return "", newError(provisioningFailure, err, "Failed to list file shares")
+	}
+
+	if len(shares) == 0 {
+		return createFileShare(tenantID, account)
+	}
+
+	options := []string{createNewOption}
+	for _, s := range shares {
+		options = append(options, s.Name)
+	}
+
+	index, err := pickIndex("Select File Share", options)
+	if err != nil {
+		return "", err
+	}
+
+	if index > 0 {
+		return shares[index-1].Name, nil
+	}
+
+	return createFileShare(tenantID, account)
+}
+
+// createFileShare creates the file share Cloud Shell keeps the home directory in
+func createFileShare(tenantID, account string) (string, error) {
+	suffix, err := randomHex(4)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := promptName("File share name", "cs-share-"+suffix, fileShareNamePattern)
+	if err != nil {
+		return "", err
+	}
+
+	id := fmt.Sprintf("%s/fileServices/default/shares/%s", account, name)
+	body := fmt.Sprintf(`{"properties":{"shareQuota":%d}}`, cloudShellShareQuota)
+	if _, err := sendRequest(tenantID, "PUT", resourceURL(id, storageAPIVersion), []byte(body)); err != nil {
+		return "", newError(provisioningFailure, err, "Failed to create file share %s", name)
+	}
+
+	return name, nil
+}
+
+// waitForResource polls a resource until its provisioning state is Succeeded
+func waitForResource(tenantID, id, apiVersion, message string) error {
+	stop := startSpinner(message)
+	defer stop()
+
+	deadline := time.Now().Add(storageCreateTimeout)
+	for {
+		header, buf, err := sendRequestWithHeader(tenantID, "GET", resourceURL(id, apiVersion), nil, nil)
+		if e, ok := err.(*armError); ok && e.StatusCode == http.StatusNotFound {
+			// Not visible yet right after the PUT
+		} else if err != nil {
+			return newError(provisioningFailure, err, "Failed to read %s", id)
+		} else {
+			var r armResource
+			if err := json.Unmarshal(buf, &r); err != nil {
+				return newError(provisioningFailure, err, "Failed to parse %s", id)
+			}
+
+			switch strings.ToLower(r.Properties.ProvisioningState) {
+			case "succeeded":
+				return nil
+			case "failed", "canceled":
+				return newError(provisioningFailure, nil, "Provisioning of %s %s", id, strings.ToLower(r.Properties.ProvisioningState))
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return newError(provisioningFailure, nil, "%s was not ready after %v", id, storageCreateTimeout)
+		}
+
+		time.Sleep(retryAfter(header))
+	}
+}
+
+// listResources GETs an ARM collection, following its next links
+func listResources(tenantID, path string) ([]armResource, error) {
+	resources := []armResource{}
+	next := activeCloud.ResourceManagerEndpoint + path
+	for next != "" {
+		buf, err := sendRequest(tenantID, "GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page armResourceList
+		if err := json.Unmarshal(buf, &page); err != nil {
+			return nil, err
+		}
+
+		resources = append(resources, page.Value...)
+		next = page.NextLink
+	}
+
+	return resources, nil
+}
+
+func resourceURL(id, apiVersion string) string {
+	return activeCloud.ResourceManagerEndpoint + id + "?api-version=" + url.QueryEscape(apiVersion)
+}
+
+func pickIndex(label string, options []string) (int, error) {
+	prompt := promptui.Select{
+		Label: label,
+		Items: options,
+		Size:  10,
+	}
+
+	index, _, err := prompt.Run()
+	if err != nil {
+		return 0, newError(usageFailure, err, "Setup cancelled")
+	}
+
+	return index, nil
+}
+
+func pickOption(label string, options []string) (string, error) {
+	index, err := pickIndex(label, options)
+	if err != nil {
+		return "", err
+	}
+
+	return options[index], nil
+}
+
+func promptName(label, defaultName string, pattern *regexp.Regexp) (string, error) {
+	prompt := promptui.Prompt{
+		Label:   label,
+		Default: defaultName,
+		Validate: func(s string) error {
+			if !pattern.MatchString(s) {
+				return fmt.Errorf("invalid name")
+			}
+			return nil
+		},
+	}
+
+	name, err := prompt.Run()
+	if err != nil {
+		return "", newError(usageFailure, err, "Setup cancelled")
+	}
+
+	return name, nil
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/manifoldco/promptui"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	cacheKeyEnvVar        = "AZSHELL_CACHE_KEY"
+	cachePassphraseEnvVar = "AZSHELL_CACHE_PASSPHRASE"
+
+	encryptedCacheVersion = 1
+	kdfScrypt             = "scrypt"
+	kdfNone               = "none"
+	cacheKeySize          = 32
+
+	// scrypt cost parameters, the recommended ones for interactive logins
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+)
+
+// encryptedToken is the on-disk envelope of an encrypted token cache file,
+// sealed with AES-256-GCM.
+type encryptedToken struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n,omitempty"`
+	R          int    `json:"r,omitempty"`
+	P          int    `json:"p,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// cacheEncryptionOptions selects where the token cache key comes from. With
+// none of them set the cache is stored in plaintext.
+type cacheEncryptionOptions struct {
+	key        []byte
+	keyFile    string
+	passphrase bool
+}
+
+var (
+	cacheEncryption cacheEncryptionOptions
+
+	passphraseOnce sync.Once
+	passphrase     string
+	passphraseErr  error
+
+	derivedKeysMu sync.Mutex
+	derivedKeys   = map[string][]byte{}
+)
+
+// configureCacheEncryption reads the cache key settings: a base64 key in
+// AZSHELL_CACHE_KEY, a key file, or a passphrase from AZSHELL_CACHE_PASSPHRASE
+// or a prompt.
+func configureCacheEncryption(s settings) error {
+	cacheEncryption = cacheEncryptionOptions{
+		keyFile:    s.CacheKeyFile,
+		passphrase: s.EncryptCache || os.Getenv(cachePassphraseEnvVar) != "",
+	}
+
+	if encoded := os.Getenv(cacheKeyEnvVar); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != cacheKeySize {
+			return fmt.Errorf("%s must be a base64 encoded %d byte key", cacheKeyEnvVar, cacheKeySize)
+		}
+
+		cacheEncryption.key = key
+	}
+
+	return nil
+}
+
+func (o cacheEncryptionOptions) enabled() bool {
+	return o.key != nil || o.keyFile != "" || o.passphrase
+}
+
+// rawKey returns the key used as is, from AZSHELL_CACHE_KEY or the key file
+func (o cacheEncryptionOptions) rawKey() ([]byte, error) {
+	if o.key != nil {
+		return o.key, nil
+	}
+
+	if o.keyFile == "" {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadFile(o.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache key file %s: %v", o.keyFile, err)
+	}
+
+	if len(buf) < cacheKeySize {
+		return nil, fmt.Errorf("cache key file %s must hold at least %d bytes", o.keyFile, cacheKeySize)
+	}
+
+	key := sha256.Sum256(buf)
+	return key[:], nil
+}
+
+func readPassphrase() (string, error) {
+	passphraseOnce.Do(func() {
+		if p := os.Getenv(cachePassphraseEnvVar); p != "" {
+			passphrase = p
+			return
+		}
+
+		if authFlags.noPrompt {
+			passphraseErr = fmt.Errorf("set %s or a cache key, the passphrase cannot be prompted for here", cachePassphraseEnvVar)
+			return
+		}
+
+		prompt := promptui.Prompt{
+			Label: "Token cache passphrase",
+			Mask:  '*',
+		}
+
+		passphrase, passphraseErr = prompt.Run()
+		if passphraseErr == nil && passphrase == "" {
+			passphraseErr = fmt.Errorf("passphrase cannot be empty")
+		}
+	})
+
+	return passphrase, passphraseErr
+}
+
+func derivePassphraseKey(salt []byte, n, r, p int) ([]byte, error) {
+	secret, err := readPassphrase()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token cache passphrase: %v", err)
+	}
+
+	derivedKeysMu.Lock()
+	defer derivedKeysMu.Unlock()
+
+	id := fmt.Sprintf("%x/%d/%d/%d", salt, n, r, p)
+	if key, ok := derivedKeys[id]; ok {
+		return key, nil
+	}
+
+	key, err := scrypt.Key([]byte(secret), salt, n, r, p, cacheKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	derivedKeys[id] = key
+	return key, nil
+}
+
+func sealToken(token adal.Token) ([]byte, error) {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := encryptedToken{Version: encryptedCacheVersion, KDF: kdfNone}
+	key, err := cacheEncryption.rawKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		envelope.KDF = kdfScrypt
+		envelope.N, envelope.R, envelope.P = scryptN, scryptR, scryptP
+		envelope.Salt = make([]byte, 16)
+		if _, err := rand.Read(envelope.Salt); err != nil {
+			return nil, err
+		}
+
+		if key, err = derivePassphraseKey(envelope.Salt, envelope.N, envelope.R, envelope.P); err != nil {
+			return nil, err
+		}
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(envelope.Nonce); err != nil {
+		return nil, err
+	}
+
+	envelope.Ciphertext = gcm.Seal(nil, envelope.Nonce, plaintext, nil)
+	return json.Marshal(envelope)
+}
+
+func openToken(envelope encryptedToken) (*adal.Token, error) {
+	var key []byte
+	var err error
+
+	switch envelope.KDF {
+	case kdfNone:
+		key, err = cacheEncryption.rawKey()
+		if err == nil && key == nil {
+			err = fmt.Errorf("set %s or cacheKeyFile to read it", cacheKeyEnvVar)
+		}
+	case kdfScrypt:
+		key, err = derivePassphraseKey(envelope.Salt, envelope.N, envelope.R, envelope.P)
+	default:
+		err = fmt.Errorf("unsupported key derivation '%s'", envelope.KDF)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("token cache is encrypted: %v", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, envelope.Nonce, envelope.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token cache, the key may be wrong: %v", err)
+	}
+
+	var token adal.Token
+	if err := json.Unmarshal(plaintext, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// loadTokenFile reads a cached token, decrypting it if needed. Plaintext
+// caches are encrypted in place once encryption is turned on.
+func loadTokenFile(path string) (*adal.Token, error) {
+	token, plaintext, err := readTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if plaintext && cacheEncryption.enabled() {
+		if err := saveTokenFile(path, *token); err != nil {
+			return nil, fmt.Errorf("failed to encrypt token cache %s: %v", path, err)
+		}
+	}
+
+	return token, nil
+}
+
+// readTokenFile reads a cached token without changing the file, and tells if
+// it is stored in plaintext
+func readTokenFile(path string) (*adal.Token, bool, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read token cache %s: %v", path, err)
+	}
+
+	var envelope encryptedToken
+	if err := json.Unmarshal(buf, &envelope); err == nil && envelope.Version > 0 {
+		token, err := openToken(envelope)
+		return token, false, err
+	}
+
+	var token adal.Token
+	if err := json.Unmarshal(buf, &token); err != nil {
+		return nil, false, fmt.Errorf("failed to decode token cache %s: %v", path, err)
+	}
+
+	return &token, true, nil
+}
+
+// saveTokenFile writes a token to the cache, encrypted when a key is configured
+func saveTokenFile(path string, token adal.Token) error {
+	if !cacheEncryption.enabled() {
+		return adal.SaveToken(path, 0600, token)
+	}
+
+	data, err := sealToken(token)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+
+	newFile, err := ioutil.TempFile(dir, "token")
+	if err != nil {
+		return fmt.Errorf("failed to create the temp file: %v", err)
+	}
+	tempPath := newFile.Name()
+
+	if _, err := newFile.Write(data); err != nil {
+		newFile.Close()
+		return fmt.Errorf("failed to write temp file %s: %v", tempPath, err)
+	}
+	if err := newFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file %s: %v", tempPath, err)
+	}
+
+	// Atomic replace to avoid multi-writer file corruptions
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to move temporary file to desired output location. src=%s dst=%s: %v", tempPath, path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("failed to chmod the file %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+var (
+	testCacheKey      = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", cacheKeySize)))
+	testOtherCacheKey = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("o", cacheKeySize)))
+)
+
+var tokenCacheTests = []struct {
+	name    string
+	saveEnv map[string]string // nil saves a plaintext cache
+	loadEnv map[string]string
+	wantErr string
+}{
+	{
+		name:    "key round trip",
+		saveEnv: map[string]string{cacheKeyEnvVar: testCacheKey},
+		loadEnv: map[string]string{cacheKeyEnvVar: testCacheKey},
+	},
+	{
+		name:    "passphrase round trip",
+		saveEnv: map[string]string{cachePassphraseEnvVar: "correct horse"},
+		loadEnv: map[string]string{cachePassphraseEnvVar: "correct horse"},
+	},
+	{
+		name:    "wrong key",
+		saveEnv: map[string]string{cacheKeyEnvVar: testCacheKey},
+		loadEnv: map[string]string{cacheKeyEnvVar: testOtherCacheKey},
+		wantErr: "the key may be wrong",
+	},
+	{
+		name:    "wrong passphrase",
+		saveEnv: map[string]string{cachePassphraseEnvVar: "correct horse"},
+		loadEnv: map[string]string{cachePassphraseEnvVar: "battery staple"},
+		wantErr: "the key may be wrong",
+	},
+	{
+		name:    "key missing",
+		saveEnv: map[string]string{cacheKeyEnvVar: testCacheKey},
+		loadEnv: map[string]string{},
+		wantErr: "token cache is encrypted",
+	},
+	{
+		name:    "plaintext migrated",
+		loadEnv: map[string]string{cacheKeyEnvVar: testCacheKey},
+	},
+	{
+		name:    "plaintext kept",
+		loadEnv: map[string]string{},
+	},
+}
+
+// useCacheEncryption configures the cache encryption from the given variables
+// only, with no passphrase or derived key left from an earlier test
+func useCacheEncryption(t *testing.T, env map[string]string) {
+	for _, name := range []string{cacheKeyEnvVar, cachePassphraseEnvVar} {
+		os.Unsetenv(name)
+		if value, ok := env[name]; ok {
+			os.Setenv(name, value)
+		}
+	}
+
+	passphraseOnce, passphrase, passphraseErr = sync.Once{}, "", nil
+	derivedKeys = map[string][]byte{}
+
+	if err := configureCacheEncryption(settings{}); err != nil {
+		t.Fatalf("configureCacheEncryption failed: %v", err)
+	}
+}
+
+func TestTokenCacheEncryption(t *testing.T) {
+	home, err := ioutil.TempDir("", "azshell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv(cacheKeyEnvVar, os.Getenv(cacheKeyEnvVar))
+	defer os.Setenv(cachePassphraseEnvVar, os.Getenv(cachePassphraseEnvVar))
+	defer useCacheEncryption(t, nil)
+	os.Setenv("HOME", home)
+
+	for _, test := range tokenCacheTests {
+		path := filepath.Join(home, ".azshell", "accessToken.test.json")
+		token := adal.Token{AccessToken: "access-" + test.name, RefreshToken: "refresh-" + test.name}
+
+		useCacheEncryption(t, test.saveEnv)
+		if err := saveTokenFile(path, token); err != nil {
+			t.Fatalf("%s: saveTokenFile failed: %v", test.name, err)
+		}
+
+		buf, _ := ioutil.ReadFile(path)
+		if encrypted := !strings.Contains(string(buf), token.RefreshToken); encrypted != (test.saveEnv != nil) {
+			t.Errorf("%s: saved cache encrypted %v, want %v", test.name, encrypted, test.saveEnv != nil)
+		}
+
+		useCacheEncryption(t, test.loadEnv)
+		loaded, err := loadTokenFile(path)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: loadTokenFile error %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: loadTokenFile failed: %v", test.name, err)
+		}
+
+		if loaded.AccessToken != token.AccessToken || loaded.RefreshToken != token.RefreshToken {
+			t.Errorf("%s: loaded %s/%s, want %s/%s", test.name, loaded.AccessToken, loaded.RefreshToken, token.AccessToken, token.RefreshToken)
+		}
+
+		// A plaintext cache is encrypted in place once a key is configured
+		_, plaintext, err := readTokenFile(path)
+		if err != nil {
+			t.Fatalf("%s: readTokenFile failed: %v", test.name, err)
+		}
+
+		if want := !cacheEncryption.enabled(); plaintext != want {
+			t.Errorf("%s: cache plaintext %v after loading, want %v", test.name, plaintext, want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/yangl900/azshell/ws"
+)
+
+const (
+	controlSocketPath = "/control?version=2019-01-01"
+
+	getTokenMessage  = "getToken"
+	postTokenMessage = "postToken"
+)
+
+// tokenRequest is Cloud Shell asking for a token of a resource, usually when
+// the one it holds is about to expire
+type tokenRequest struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Audience string `json:"audience"`
+}
+
+// tokenResponse answers a tokenRequest with a token or the reason there is none
+type tokenResponse struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Audience string `json:"audience"`
+	Token    string `json:"token,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// tokenChannel answers the token requests of a Cloud Shell session the way
+// the browser portal does, so tools in the session stay signed in to Graph,
+// Key Vault and other resources after the tokens of the terminal request expire.
+// Only non-interactive providers are used, the terminal is in raw mode.
+type tokenChannel struct {
+	tenantID string
+	provider TokenProvider
+	channel  *ws.Channel
+}
+
+// openTokenChannel connects to the control socket of the console
+func openTokenChannel(tenantID, consoleURI string) (*tokenChannel, error) {
+	uri, err := controlSocketURI(consoleURI)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := nonInteractiveCredentials()
+	token, err := provider.Token(tenantID, activeCloud.ResourceManagerAudience)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := ws.NewWebsocketChannel(ws.Config{
+		ConnectRetryWaitDuration: time.Second * 1,
+		ConnectRetries:           1,
+		SendReceiveBufferSize:    16,
+		URL:                      uri,
+		Header:                   http.Header{"Authorization": {token}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenChannel{tenantID: tenantID, provider: provider, channel: channel}, nil
+}
+
+// controlSocketURI is the websocket of the console that carries its token requests
+func controlSocketURI(consoleURI string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(consoleURI, "/") + controlSocketPath)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("console URI %s is not https", consoleURI)
+	}
+
+	u.Scheme = "wss"
+	return u.String(), nil
+}
+
+// serve answers token requests until the console closes the socket
+func (c *tokenChannel) serve() {
+	for msg := range c.channel.ReadChannel() {
+		req := tokenRequest{}
+		if err := json.Unmarshal(msg, &req); err != nil || req.Type != getTokenMessage {
+			continue
+		}
+
+		buf, err := json.Marshal(c.answer(req))
+		if err != nil {
+			continue
+		}
+
+		if err := c.channel.Send(buf); err != nil {
+			log.Printf("[azshell] Failed to send a token to Cloud Shell: %v\r\n", err)
+			return
+		}
+	}
+}
+
+func (c *tokenChannel) answer(req tokenRequest) tokenResponse {
+	resp := tokenResponse{Type: postTokenMessage, ID: req.ID, Audience: req.Audience}
+	if req.Audience == "" {
+		resp.Error = "no audience requested"
+		return resp
+	}
+
+	token, err := c.provider.Token(c.tenantID, req.Audience)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+
+	resp.Token = token[strings.Index(token, " ")+1:]
+	return resp
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	execCredentialAPIVersion = "client.authentication.k8s.io/v1beta1"
+	execInfoEnvVar           = "KUBERNETES_EXEC_INFO"
+
+	// azCliExpiresOnFormat is the local time format of expiresOn in az account get-access-token
+	azCliExpiresOnFormat = "2006-01-02 15:04:05.000000"
+)
+
+// accessTokenOutput matches the output of az account get-access-token
+type accessTokenOutput struct {
+	AccessToken string `json:"accessToken"`
+	ExpiresOn   string `json:"expiresOn"`
+	ExpiresOnTS int64  `json:"expires_on"`
+	Tenant      string `json:"tenant"`
+	TokenType   string `json:"tokenType"`
+}
+
+// execCredential is the kubectl exec credential plugin output
+type execCredential struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Status     execCredentialStatus `json:"status"`
+}
+
+type execCredentialStatus struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp"`
+}
+
+func runToken(args []string) error {
+	var authMethods, resource, scope, tenantID, output string
+
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	fs.StringVar(&resource, "resource", "", "Resource to get the token for (default Azure Resource Manager).")
+	fs.StringVar(&scope, "scope", "", "Scope to get the token for, e.g. https://graph.microsoft.com/.default.")
+	fs.StringVar(&tenantID, "tenant", "", "Tenant to get the token for (default the active tenant).")
+	fs.StringVar(&output, "output", "json", "Output format, json, raw or exec-credential.")
+	addAuthFlags(fs, &authMethods)
+	fs.Parse(args)
+
+	if output != "json" && output != "raw" && output != "exec-credential" {
+		return newError(usageFailure, nil, "Unknown output format '%s', use json, raw or exec-credential", output)
+	}
+
+	if resource != "" && scope != "" {
+		return newError(usageFailure, nil, "Specify either --resource or --scope")
+	}
+
+	if scope != "" {
+		if !strings.HasSuffix(scope, "/.default") {
+			return newError(usageFailure, nil, "Only .default scopes are supported, e.g. %s/.default", strings.TrimSuffix(scope, "/"))
+		}
+
+		resource = strings.TrimSuffix(scope, "/.default")
+	}
+
+	// The output may be read by another program, a prompt must not end up in it
+	authFlags.tenantID = tenantID
+	authFlags.noPrompt = true
+	if err := configureCredentials(authMethods); err != nil {
+		return newError(usageFailure, err, "Invalid options")
+	}
+
+	if err := selectAccount(); err != nil {
+		return accountError(err)
+	}
+
+	if resource == "" {
+		resource = activeCloud.ResourceManagerAudience
+	}
+
+	if tenantID == "" {
+		s, _ := readSettings()
+		tenantID = firstNonEmpty(s.ActiveTenant, commonTenant)
+	}
+
+	token, err := nonInteractiveCredentials().Token(tenantID, resource)
+	if err != nil {
+		return newError(authFailure, err, "Failed to get a token, run '%s login' first", os.Args[0])
+	}
+
+	tokenType, accessToken := "Bearer", token
+	if i := strings.Index(token, " "); i >= 0 {
+		tokenType, accessToken = token[:i], token[i+1:]
+	}
+
+	expiresOn := time.Now().Add(time.Hour)
+	if claims, err := parseTokenClaims(accessToken); err == nil {
+		if exp := claimTime(claims, "exp"); !exp.IsZero() {
+			expiresOn = exp
+		}
+
+		tenantID = firstNonEmpty(claimString(claims, "tid"), tenantID)
+	}
+
+	switch output {
+	case "raw":
+		fmt.Println(accessToken)
+		return nil
+	case "exec-credential":
+		return printJSON(execCredential{
+			APIVersion: execCredentialVersion(),
+			Kind:       "ExecCredential",
+			Status: execCredentialStatus{
+				Token:               accessToken,
+				ExpirationTimestamp: expiresOn.UTC().Format(time.RFC3339),
+			},
+		})
+	default:
+		return printJSON(accessTokenOutput{
+			AccessToken: accessToken,
+			ExpiresOn:   expiresOn.Local().Format(azCliExpiresOnFormat),
+			ExpiresOnTS: expiresOn.Unix(),
+			Tenant:      tenantID,
+			TokenType:   tokenType,
+		})
+	}
+}
+
+// execCredentialVersion answers kubectl in the API version it asked for
+func execCredentialVersion() string {
+	info := struct {
+		APIVersion string `json:"apiVersion"`
+	}{}
+
+	if json.Unmarshal([]byte(os.Getenv(execInfoEnvVar)), &info) == nil && info.APIVersion != "" {
+		return info.APIVersion
+	}
+
+	return execCredentialAPIVersion
+}
+
+func printJSON(v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(buf))
+	return nil
+}
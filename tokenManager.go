@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenRetryInterval  = 30 * time.Second
+	tokenMinimumRefresh = 30 * time.Second
+)
+
+// tokenManager keeps the token of a connected session fresh in the
+// background. It only uses the non-interactive providers, so no login prompt
+// can interrupt the terminal while it is in raw mode.
+type tokenManager struct {
+	tenantID string
+	provider TokenProvider
+
+	mu        sync.RWMutex
+	token     string
+	expiresOn time.Time
+	err       error
+}
+
+func newTokenManager(tenantID string, provider TokenProvider) (*tokenManager, error) {
+	if chain, ok := provider.(*tokenProviderChain); ok {
+		provider = chain.nonInteractive()
+	}
+
+	m := &tokenManager{tenantID: tenantID, provider: provider}
+	if err := m.refresh(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *tokenManager) Name() string {
+	return "session"
+}
+
+// Token returns the current Resource Manager token of the session tenant.
+// Other tenants and resources are served by the non-interactive providers directly.
+func (m *tokenManager) Token(tenantID, resource string) (string, error) {
+	if !strings.EqualFold(tenantID, m.tenantID) || resource != activeCloud.ResourceManagerAudience {
+		return m.provider.Token(tenantID, resource)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.err != nil && !time.Now().Before(m.expiresOn) {
+		return "", fmt.Errorf("token expired and could not be refreshed: %v", m.err)
+	}
+
+	return m.token, nil
+}
+
+func (m *tokenManager) refresh() error {
+	token, err := m.provider.Token(m.tenantID, activeCloud.ResourceManagerAudience)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiresOn := time.Now().Add(time.Hour)
+	if err == nil {
+		if claims, err := parseTokenClaims(token[strings.Index(token, " ")+1:]); err == nil {
+			if exp, ok := claims["exp"].(float64); ok {
+				expiresOn = time.Unix(int64(exp), 0)
+			}
+		}
+
+		// A provider with a static token, e.g. env, keeps returning it after it expired
+		if !time.Now().Before(expiresOn) {
+			err = fmt.Errorf("%s returned a token that expired at %s", m.provider.Name(), expiresOn.Local().Format(time.RFC3339))
+		}
+	}
+
+	if err != nil {
+		m.err = err
+		return err
+	}
+
+	m.token = token
+	m.expiresOn = expiresOn
+	m.err = nil
+	return nil
+}
+
+// run refreshes the token ahead of its expiry until the process exits
+func (m *tokenManager) run() {
+	reported := false
+	for {
+		m.mu.RLock()
+		wait := time.Until(m.expiresOn.Add(-tokenRefreshWindow))
+		failed := m.err != nil
+		m.mu.RUnlock()
+
+		if failed {
+			wait = tokenRetryInterval
+		} else if wait < tokenMinimumRefresh {
+			wait = tokenMinimumRefresh
+		}
+
+		time.Sleep(wait)
+
+		err := m.refresh()
+		if err == nil {
+			reported = false
+			continue
+		}
+
+		m.mu.RLock()
+		expired := !time.Now().Before(m.expiresOn)
+		m.mu.RUnlock()
+
+		if expired && !reported {
+			reported = true
+			log.Printf("[azshell] The access token expired and could not be refreshed without a prompt: %v\r\n", err)
+			log.Printf("[azshell] Run 'azshell login' in another terminal to sign in again.\r\n")
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+const (
+	accessTokenEnvVar = "AZSHELL_ACCESS_TOKEN"
+
+	// tokenRefreshWindow is how long before expiry tokens are renewed
+	tokenRefreshWindow = 5 * time.Minute
+)
+
+// TokenProvider acquires access tokens for a tenant
+type TokenProvider interface {
+	// Name is the identifier used to select the provider with --auth
+	Name() string
+
+	// Token returns the authorization header value ("<type> <token>") for the
+	// resource, e.g. activeCloud.ResourceManagerAudience, in the tenant
+	Token(tenantID, resource string) (string, error)
+}
+
+// interactiveTokenProvider is implemented by providers that prompt the user
+type interactiveTokenProvider interface {
+	Interactive() bool
+}
+
+// credentialUnavailableError means a provider cannot be used in the current
+// environment, so the chain should move on to the next provider.
+type credentialUnavailableError struct {
+	message string
+}
+
+func (e *credentialUnavailableError) Error() string {
+	return e.message
+}
+
+func credentialUnavailable(format string, a ...interface{}) error {
+	return &credentialUnavailableError{message: fmt.Sprintf(format, a...)}
+}
+
+var (
+	defaultAuthMethods = []string{"env", "process", "serviceprincipal", "workloadidentity", "msi", "cache", "azcli", "devicecode"}
+
+	tokenProviders = map[string]func() TokenProvider{
+		"env":              func() TokenProvider { return &envTokenProvider{} },
+		"process":          func() TokenProvider { return &credentialProcessTokenProvider{} },
+		"serviceprincipal": func() TokenProvider { return &servicePrincipalTokenProvider{} },
+		"workloadidentity": func() TokenProvider { return &workloadIdentityTokenProvider{} },
+		"msi":              func() TokenProvider { return &msiTokenProvider{} },
+		"cache":            func() TokenProvider { return &cachedTokenProvider{} },
+		"azcli":            func() TokenProvider { return &azCliTokenProvider{} },
+		"devicecode":       func() TokenProvider { return &deviceCodeTokenProvider{} },
+		"browser":          func() TokenProvider { return &browserTokenProvider{} },
+	}
+
+	credentials TokenProvider = mustNewTokenProviderChain(defaultAuthMethods)
+)
+
+// authOptions holds the credentials given on the command line. They take
+// precedence over the standard AZURE_* environment variables.
+type authOptions struct {
+	tenantID                  string
+	clientID                  string
+	clientSecret              string
+	clientCertificatePath     string
+	clientCertificatePassword string
+
+	identityClientID   string
+	identityObjectID   string
+	identityResourceID string
+
+	credentialProcess string
+
+	cloud         string
+	loginEndpoint string
+	account       string
+
+	deviceCodeOutput  string
+	deviceCodeTimeout time.Duration
+
+	// noPrompt turns the account and passphrase prompts into errors, for
+	// commands whose output is read by other programs
+	noPrompt bool
+}
+
+var authFlags authOptions
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// addAuthFlags registers the flags selecting and configuring the authentication methods
+func addAuthFlags(fs *flag.FlagSet, authMethods *string) {
+	fs.StringVar(&authFlags.cloud, "cloud", "", fmt.Sprintf("Azure cloud to connect to (%s), or the https URL of a custom Resource Manager endpoint.", strings.Join(cloudNames(), "|")))
+	fs.StringVar(&authFlags.account, "account", "", "User account to sign in with when several are signed in.")
+	fs.StringVar(&authFlags.loginEndpoint, "login-endpoint", "", "Azure AD endpoint version for user login, v1 or v2 (default v2).")
+	fs.StringVar(authMethods, "auth", "", fmt.Sprintf("Comma separated authentication methods to try in order (%s).", strings.Join(authMethodNames(), "|")))
+	fs.StringVar(&authFlags.clientID, "client-id", "", "Service principal client Id (default $AZURE_CLIENT_ID).")
+	fs.StringVar(&authFlags.clientSecret, "client-secret", "", "Service principal client secret (default $AZURE_CLIENT_SECRET).")
+	fs.StringVar(&authFlags.clientCertificatePath, "client-certificate", "", "Path to the service principal PEM or PFX certificate with its private key (default $AZURE_CLIENT_CERTIFICATE_PATH).")
+	fs.StringVar(&authFlags.clientCertificatePassword, "client-certificate-password", "", "Password of the PFX certificate (default $AZURE_CLIENT_CERTIFICATE_PASSWORD).")
+	fs.StringVar(&authFlags.identityClientID, "identity-client-id", "", "Client Id of the user-assigned managed identity to use.")
+	fs.StringVar(&authFlags.identityObjectID, "identity-object-id", "", "Object Id of the user-assigned managed identity to use.")
+	fs.StringVar(&authFlags.identityResourceID, "identity-resource-id", "", "Resource Id of the user-assigned managed identity to use.")
+	fs.StringVar(&authFlags.deviceCodeOutput, "device-code-output", "text", "How to show the device code login, text (with a QR code) or json on stderr.")
+	fs.DurationVar(&authFlags.deviceCodeTimeout, "device-code-timeout", 0, "How long to wait for a device code login (default until the code expires).")
+	fs.StringVar(&authFlags.credentialProcess, "credential-process", "", "Command printing an access token as JSON, used by the 'process' authentication method.")
+}
+
+// configureCredentials sets up the cloud and the token provider chain from
+// the flags, falling back to the persisted settings.
+func configureCredentials(authMethods string) error {
+	userSettings, _ := readSettings()
+	if err := selectCloud(firstNonEmpty(authFlags.cloud, userSettings.Cloud)); err != nil {
+		return err
+	}
+
+	if err := selectLoginEndpoint(firstNonEmpty(authFlags.loginEndpoint, userSettings.LoginEndpoint)); err != nil {
+		return err
+	}
+
+	if err := validateDeviceCodeOutput(authFlags.deviceCodeOutput); err != nil {
+		return err
+	}
+
+	if err := configureCacheEncryption(userSettings); err != nil {
+		return err
+	}
+
+	activeAccount = accountName(authFlags.account)
+
+	if authMethods == "" {
+		authMethods = strings.Join(userSettings.AuthMethods, ",")
+	}
+
+	authFlags.credentialProcess = firstNonEmpty(authFlags.credentialProcess, userSettings.CredentialProcess)
+
+	if authMethods == "" {
+		return nil
+	}
+
+	chain, err := newTokenProviderChain(strings.Split(authMethods, ","))
+	if err != nil {
+		return err
+	}
+
+	// msi was selected explicitly, it may probe the instance metadata service
+	for _, p := range chain.providers {
+		if msi, ok := p.(*msiTokenProvider); ok {
+			msi.useIMDS = true
+		}
+	}
+
+	credentials = chain
+	return nil
+}
+
+// tokenProviderChain tries each provider in order until one returns a token
+type tokenProviderChain struct {
+	providers []TokenProvider
+}
+
+func newTokenProviderChain(methods []string) (*tokenProviderChain, error) {
+	chain := &tokenProviderChain{}
+	for _, m := range methods {
+		m = strings.ToLower(strings.TrimSpace(m))
+		if m == "" {
+			continue
+		}
+
+		newProvider, ok := tokenProviders[m]
+		if !ok {
+			return nil, fmt.Errorf("unknown authentication method '%s', supported methods are %s", m, strings.Join(authMethodNames(), ", "))
+		}
+
+		chain.providers = append(chain.providers, newProvider())
+	}
+
+	if len(chain.providers) == 0 {
+		return nil, fmt.Errorf("at least one authentication method is required")
+	}
+
+	return chain, nil
+}
+
+func mustNewTokenProviderChain(methods []string) *tokenProviderChain {
+	chain, err := newTokenProviderChain(methods)
+	if err != nil {
+		panic(err)
+	}
+
+	return chain
+}
+
+func authMethodNames() []string {
+	names := []string{}
+	for m := range tokenProviders {
+		names = append(names, m)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (c *tokenProviderChain) Name() string {
+	names := []string{}
+	for _, p := range c.providers {
+		names = append(names, p.Name())
+	}
+
+	return strings.Join(names, ",")
+}
+
+// nonInteractive returns the chain without the providers that prompt the user
+func (c *tokenProviderChain) nonInteractive() *tokenProviderChain {
+	chain := &tokenProviderChain{}
+	for _, p := range c.providers {
+		if i, ok := p.(interactiveTokenProvider); ok && i.Interactive() {
+			continue
+		}
+
+		chain.providers = append(chain.providers, p)
+	}
+
+	return chain
+}
+
+// nonInteractiveCredentials are the credentials without the providers that prompt
+func nonInteractiveCredentials() TokenProvider {
+	if chain, ok := credentials.(*tokenProviderChain); ok {
+		return chain.nonInteractive()
+	}
+
+	return credentials
+}
+
+func (c *tokenProviderChain) Token(tenantID, resource string) (string, error) {
+	token, _, err := c.tokenWithProvider(tenantID, resource)
+	return token, err
+}
+
+// tokenWithProvider is Token, also returning the name of the provider that served the token
+func (c *tokenProviderChain) tokenWithProvider(tenantID, resource string) (string, string, error) {
+	reasons := []string{}
+	for _, p := range c.providers {
+		token, err := p.Token(tenantID, resource)
+		if err == nil {
+			return token, p.Name(), nil
+		}
+
+		if _, ok := err.(*credentialUnavailableError); !ok {
+			return "", "", fmt.Errorf("%s: %v", p.Name(), err)
+		}
+
+		reasons = append(reasons, fmt.Sprintf("%s: %v", p.Name(), err))
+	}
+
+	return "", "", fmt.Errorf("no credential available for %s in tenant %s (%s)", resource, tenantID, strings.Join(reasons, "; "))
+}
+
+// envTokenProvider uses a ready-made access token from the environment
+type envTokenProvider struct{}
+
+func (p *envTokenProvider) Name() string {
+	return "env"
+}
+
+func (p *envTokenProvider) Token(tenantID, resource string) (string, error) {
+	if resource != activeCloud.ResourceManagerAudience {
+		return "", credentialUnavailable("%s only holds a Resource Manager token", accessTokenEnvVar)
+	}
+
+	token, ok := os.LookupEnv(accessTokenEnvVar)
+	if !ok || token == "" {
+		return "", credentialUnavailable("%s is not set", accessTokenEnvVar)
+	}
+
+	if !strings.Contains(token, " ") {
+		token = "Bearer " + token
+	}
+
+	return token, nil
+}
+
+// cachedTokenProvider uses the tokens cached in $HOME/.azshell, refreshing them
+// when expired. It never prompts the user. Only Resource Manager tokens are
+// written to disk, tokens of other resources are kept in memory.
+type cachedTokenProvider struct {
+	mu             sync.Mutex
+	resourceTokens map[string]adal.Token
+}
+
+func (p *cachedTokenProvider) Name() string {
+	return "cache"
+}
+
+func (p *cachedTokenProvider) Token(tenantID, resource string) (string, error) {
+	if resource != activeCloud.ResourceManagerAudience {
+		return p.resourceToken(tenantID, resource)
+	}
+
+	path := defaultTokenCachePath(tenantID)
+	if _, err := os.Stat(path); err == nil {
+		// Hold the lock from reading to saving the refreshed token. A process
+		// waiting on it then finds the fresh token instead of refreshing again.
+		unlock, err := lockTokenCache()
+		if err != nil {
+			return "", err
+		}
+
+		token, err := loadTokenFile(path)
+		if err != nil {
+			unlock()
+			return "", err
+		}
+
+		if !token.WillExpireIn(tokenRefreshWindow) {
+			unlock()
+			return authorizationHeader(*token), nil
+		}
+
+		token, err = refreshToken(tenantID, resource, path)
+		if err == nil {
+			err = saveToken(*token, tenantID)
+			unlock()
+			if err != nil {
+				return "", err
+			}
+
+			return authorizationHeader(*token), nil
+		}
+		unlock()
+	}
+
+	// The refresh token of the common tenant can be redeemed for any tenant the user belongs to.
+	if tenantID != commonTenant {
+		if _, err := os.Stat(defaultTokenCachePath(commonTenant)); err == nil {
+			if token, err := redeemCommonRefreshToken(tenantID); err == nil {
+				return token, nil
+			}
+		}
+	}
+
+	return "", credentialUnavailable("no valid cached token for tenant %s", tenantID)
+}
+
+func (p *cachedTokenProvider) resourceToken(tenantID, resource string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := strings.ToLower(tenantID + "/" + resource)
+	if token, ok := p.resourceTokens[key]; ok && !token.WillExpireIn(tokenRefreshWindow) {
+		return authorizationHeader(token), nil
+	}
+
+	// Make sure the tenant cache holds a fresh refresh token first.
+	if _, err := p.Token(tenantID, activeCloud.ResourceManagerAudience); err != nil {
+		return "", err
+	}
+
+	token, err := exchangeRefreshToken(tenantID, resource)
+	if err != nil {
+		return "", credentialUnavailable("%v", err)
+	}
+
+	if p.resourceTokens == nil {
+		p.resourceTokens = map[string]adal.Token{}
+	}
+	p.resourceTokens[key] = *token
+
+	return authorizationHeader(*token), nil
+}
+
+// deviceCodeTokenProvider signs the user in interactively with the device code flow
+type deviceCodeTokenProvider struct{}
+
+func (p *deviceCodeTokenProvider) Name() string {
+	return "devicecode"
+}
+
+func (p *deviceCodeTokenProvider) Interactive() bool {
+	return true
+}
+
+func (p *deviceCodeTokenProvider) Token(tenantID, resource string) (string, error) {
+	if resource != activeCloud.ResourceManagerAudience {
+		return interactiveResourceToken(p, tenantID, resource)
+	}
+
+	if tenantID != commonTenant {
+		if _, err := p.Token(commonTenant, resource); err != nil {
+			return "", err
+		}
+
+		return redeemCommonRefreshToken(tenantID)
+	}
+
+	token, err := deviceCodeLogin(tenantID, resource, "")
+	if err != nil {
+		return "", err
+	}
+
+	if err := saveToken(*token, tenantID); err != nil {
+		return "", err
+	}
+
+	return authorizationHeader(*token), nil
+}
+
+func (p *deviceCodeTokenProvider) TokenWithClaims(tenantID, claims string) (string, error) {
+	token, err := deviceCodeLogin(tenantID, activeCloud.ResourceManagerAudience, claims)
+	if err != nil {
+		return "", err
+	}
+
+	if err := saveToken(*token, tenantID); err != nil {
+		return "", err
+	}
+
+	return authorizationHeader(*token), nil
+}
+
+// interactiveResourceToken signs in for Resource Manager, then redeems the
+// refresh token for the resource.
+func interactiveResourceToken(p TokenProvider, tenantID, resource string) (string, error) {
+	if _, err := p.Token(tenantID, activeCloud.ResourceManagerAudience); err != nil {
+		return "", err
+	}
+
+	token, err := exchangeRefreshToken(tenantID, resource)
+	if err != nil {
+		return "", err
+	}
+
+	return authorizationHeader(*token), nil
+}
+
+// exchangeRefreshToken redeems the cached refresh token of the tenant for a
+// token of another resource. Only the rotated refresh token is written back
+// to the cache, the access token there stays the Resource Manager one.
+func exchangeRefreshToken(tenantID, resource string) (*adal.Token, error) {
+	unlock, err := lockTokenCache()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cached, err := loadTokenFile(defaultTokenCachePath(tenantID))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := redeemRefreshToken(tenantID, resource, cached.RefreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire token for %s: %v", resource, err)
+	}
+
+	if token.RefreshToken != "" && token.RefreshToken != cached.RefreshToken {
+		cached.RefreshToken = token.RefreshToken
+		if err := saveToken(*cached, tenantID); err != nil {
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+// redeemCommonRefreshToken exchanges the cached refresh token of the common
+// tenant for a token of tenantID, caching the result.
+func redeemCommonRefreshToken(tenantID string) (string, error) {
+	unlock, err := lockTokenCache()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	token, err := refreshToken(tenantID, activeCloud.ResourceManagerAudience, defaultTokenCachePath(commonTenant))
+	if err != nil {
+		return "", err
+	}
+
+	if err := saveToken(*token, tenantID); err != nil {
+		return "", err
+	}
+
+	return authorizationHeader(*token), nil
+}
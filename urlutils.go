@@ -7,11 +7,6 @@ import (
 	"strings"
 )
 
-const (
-	armEndpoint       string = "https://management.azure.com"
-	armEndpointSuffix string = "management.azure.com"
-)
-
 func isArmURLPath(urlPath string) bool {
 	urlPath = strings.ToLower(urlPath)
 	return strings.HasPrefix(urlPath, "/subscriptions") ||
@@ -27,14 +22,14 @@ func getRequestURL(path string) (string, error) {
 			return "", errors.New("Url path specified is invalid")
 		}
 
-		return armEndpoint + path, nil
+		return activeCloud.ResourceManagerEndpoint + path, nil
 	}
 
 	if u.Scheme != "https" {
 		return "", errors.New("Scheme must be https")
 	}
 
-	if !strings.HasSuffix(u.Hostname(), armEndpointSuffix) {
+	if !strings.HasSuffix(u.Hostname(), activeCloud.resourceManagerHost()) {
 		return "", fmt.Errorf("'%s' is not an ARM endpoint", u.Hostname())
 	}
 
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// identity is what azshell knows about the signed in identity, decoded from
+// its Resource Manager token
+type identity struct {
+	User       string    `json:"user,omitempty"`
+	AppID      string    `json:"appId,omitempty"`
+	ObjectID   string    `json:"objectId,omitempty"`
+	TenantID   string    `json:"tenantId,omitempty"`
+	Audience   []string  `json:"audience,omitempty"`
+	Scopes     []string  `json:"scopes,omitempty"`
+	Roles      []string  `json:"roles,omitempty"`
+	IssuedAt   time.Time `json:"issuedAt"`
+	ExpiresOn  time.Time `json:"expiresOn"`
+	AuthMethod string    `json:"authMethod"`
+	Cloud      string    `json:"cloud"`
+}
+
+func runWhoami(args []string) error {
+	var authMethods, tenantID, output string
+
+	fs := flag.NewFlagSet("whoami", flag.ExitOnError)
+	fs.StringVar(&tenantID, "tenant", "", "Tenant to show the identity of (default the active tenant).")
+	fs.StringVar(&output, "output", "text", "Output format, text or json.")
+	addAuthFlags(fs, &authMethods)
+	fs.Parse(args)
+
+	if output != "text" && output != "json" {
+		return newError(usageFailure, nil, "Unknown output format '%s', use text or json", output)
+	}
+
+	authFlags.tenantID = tenantID
+	if err := configureCredentials(authMethods); err != nil {
+		return newError(usageFailure, err, "Invalid options")
+	}
+
+	if err := selectAccount(); err != nil {
+		return accountError(err)
+	}
+
+	if tenantID == "" {
+		s, _ := readSettings()
+		tenantID = firstNonEmpty(s.ActiveTenant, commonTenant)
+	}
+
+	chain, ok := credentials.(*tokenProviderChain)
+	if !ok {
+		return fmt.Errorf("no token provider chain configured")
+	}
+
+	// whoami only reports on existing credentials, it never prompts for a login
+	token, method, err := chain.nonInteractive().tokenWithProvider(tenantID, activeCloud.ResourceManagerAudience)
+	if err != nil {
+		return newError(authFailure, err, "Not signed in to tenant %s", tenantID)
+	}
+
+	claims, err := parseTokenClaims(token[strings.Index(token, " ")+1:])
+	if err != nil {
+		return newError(authFailure, err, "Failed to decode the access token")
+	}
+
+	id := identity{
+		User:       claimString(claims, "upn", "unique_name", "email", "preferred_username"),
+		AppID:      claimString(claims, "appid", "azp"),
+		ObjectID:   claimString(claims, "oid"),
+		TenantID:   claimString(claims, "tid"),
+		Audience:   claimStrings(claims, "aud"),
+		Scopes:     strings.Fields(claimString(claims, "scp")),
+		Roles:      claimStrings(claims, "roles"),
+		IssuedAt:   claimTime(claims, "iat"),
+		ExpiresOn:  claimTime(claims, "exp"),
+		AuthMethod: method,
+		Cloud:      activeCloud.Name,
+	}
+
+	if output == "json" {
+		return printJSON(id)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "User:\t%s\n", firstNonEmpty(id.User, id.AppID))
+	fmt.Fprintf(w, "App Id:\t%s\n", id.AppID)
+	fmt.Fprintf(w, "Object Id:\t%s\n", id.ObjectID)
+	fmt.Fprintf(w, "Tenant Id:\t%s\n", id.TenantID)
+	fmt.Fprintf(w, "Audience:\t%s\n", strings.Join(id.Audience, ", "))
+	fmt.Fprintf(w, "Scopes:\t%s\n", strings.Join(id.Scopes, " "))
+	fmt.Fprintf(w, "Roles:\t%s\n", strings.Join(id.Roles, ", "))
+	fmt.Fprintf(w, "Issued:\t%s\n", id.IssuedAt.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Expires:\t%s\n", id.ExpiresOn.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Auth method:\t%s\n", id.AuthMethod)
+	fmt.Fprintf(w, "Cloud:\t%s\n", id.Cloud)
+	return w.Flush()
+}
+
+// claimStrings reads a claim that is a string or an array of strings
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+
+		return values
+	}
+
+	return nil
+}
+
+// claimTime reads a NumericDate claim such as exp or iat
+func claimTime(claims jwt.MapClaims, name string) time.Time {
+	if v, ok := claims[name].(float64); ok {
+		return time.Unix(int64(v), 0)
+	}
+
+	return time.Time{}
+}
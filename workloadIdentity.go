@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+const (
+	federatedTokenFileEnvVar = "AZURE_FEDERATED_TOKEN_FILE"
+	clientAssertionType      = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// federatedTokenSecret authenticates with a client assertion read from a
+// federated token file. The file is rotated by the platform, so it is read
+// again on every refresh.
+type federatedTokenSecret struct {
+	path string
+}
+
+// SetAuthenticationValues implements adal.ServicePrincipalSecret
+func (s *federatedTokenSecret) SetAuthenticationValues(spt *adal.ServicePrincipalToken, v *url.Values) error {
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read federated token file %s: %v", s.path, err)
+	}
+
+	assertion := strings.TrimSpace(string(buf))
+	if assertion == "" {
+		return fmt.Errorf("federated token file %s is empty", s.path)
+	}
+
+	v.Set("client_assertion_type", clientAssertionType)
+	v.Set("client_assertion", assertion)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (s federatedTokenSecret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		Path string `json:"path"`
+	}{
+		Type: "FederatedTokenSecret",
+		Path: s.path,
+	})
+}
+
+// workloadIdentityTokenProvider signs in with workload identity federation, as
+// set up by AKS workload identity or a CI system issuing OIDC tokens.
+type workloadIdentityTokenProvider struct {
+	mu     sync.Mutex
+	tokens map[string]*adal.ServicePrincipalToken
+}
+
+func (p *workloadIdentityTokenProvider) Name() string {
+	return "workloadidentity"
+}
+
+func (p *workloadIdentityTokenProvider) Token(tenantID, resource string) (string, error) {
+	tokenFile := os.Getenv(federatedTokenFileEnvVar)
+	clientID := firstNonEmpty(authFlags.clientID, os.Getenv(clientIDEnvVar))
+
+	if tokenFile == "" || clientID == "" {
+		return "", credentialUnavailable("%s and %s are not set", federatedTokenFileEnvVar, clientIDEnvVar)
+	}
+
+	tenantID, err := applicationTenant(tenantID)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := strings.ToLower(tenantID + "/" + resource)
+	spt, ok := p.tokens[key]
+	if !ok {
+		oauthConfig, err := adal.NewOAuthConfig(activeCloud.ActiveDirectoryEndpoint, tenantID)
+		if err != nil {
+			return "", err
+		}
+
+		spt, err = adal.NewServicePrincipalTokenWithSecret(*oauthConfig, clientID, resource, &federatedTokenSecret{path: tokenFile})
+		if err != nil {
+			return "", fmt.Errorf("failed to create workload identity token: %v", err)
+		}
+
+		if p.tokens == nil {
+			p.tokens = map[string]*adal.ServicePrincipalToken{}
+		}
+		p.tokens[key] = spt
+	}
+
+	if err := spt.EnsureFresh(); err != nil {
+		return "", fmt.Errorf("failed to acquire token for workload identity %s: %v", clientID, err)
+	}
+
+	return authorizationHeader(spt.Token()), nil
+}
@@ -3,6 +3,7 @@ package ws
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
@@ -32,8 +33,10 @@ type Channel struct {
 // Config containers the configuratinos for the websocket channel
 type Config struct {
 	ConnectRetryWaitDuration time.Duration
+	ConnectRetries           int // 0 retries forever
 	SendReceiveBufferSize    int
 	URL                      string
+	Header                   http.Header // sent with the handshake, e.g. Authorization
 }
 
 func (c *Config) validateConfig() error {
@@ -56,7 +59,9 @@ func NewWebsocketChannel(config Config) (*Channel, error) {
 		config:  config,
 	}
 
-	c.connect()
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
 
 	go c.setupReceiveChannel()
 
@@ -80,19 +85,23 @@ func (c *Channel) Send(msg []byte) error {
 	return err
 }
 
-func (c *Channel) connect() {
+func (c *Channel) connect() error {
 	var conn *websocket.Conn
 	var err error
 
 	// try to connect to the web socket with retry
-	for {
-		conn, _, err = websocket.DefaultDialer.Dial(c.config.URL, nil)
+	for attempt := 0; ; attempt++ {
+		conn, _, err = websocket.DefaultDialer.Dial(c.config.URL, c.config.Header)
 		if err == nil {
 			break
 		}
 
 		logger.Printf("failed to connect to websocket: %s with error :%v", c.config.URL, err)
 
+		if c.config.ConnectRetries > 0 && attempt >= c.config.ConnectRetries {
+			return fmt.Errorf("websocket: failed to connect after %d retries: %v", c.config.ConnectRetries, err)
+		}
+
 		time.Sleep(c.config.ConnectRetryWaitDuration)
 	}
 
@@ -101,6 +110,7 @@ func (c *Channel) connect() {
 	}
 
 	c.conn = conn
+	return nil
 }
 
 func (c *Channel) setupReceiveChannel() {